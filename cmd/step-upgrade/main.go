@@ -0,0 +1,41 @@
+// step-upgrade 将数据目录中旧格式的文件改写为当前格式
+//
+//	step-upgrade [-encrypted] <directory>
+//
+// 升级期间不能有其他进程打开这个目录，原来的目录保留为 <directory>.backup
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	step "step/src"
+)
+
+func main() {
+	encrypted := flag.Bool("encrypted", false, "the data directory was written with encryption enabled")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-encrypted] <directory>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dir := flag.Arg(0)
+
+	err := step.Upgrade(dir, func(opt *step.UpgradeOption) {
+		opt.Encrypted = *encrypted
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "step-upgrade: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("upgraded %s\n", dir)
+}
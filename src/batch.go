@@ -0,0 +1,116 @@
+package step
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Batch 批量写入
+// Put 和 Delete 操作先保存在内存中，提交时作为一个整体写入数据文件
+// 恢复数据时批量写入中的操作要么全部生效，要么全部不生效
+type Batch struct {
+	items []*Item
+}
+
+// NewBatch 创建一个空的批量写入
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put 在批量写入中添加一个 KV
+func (b *Batch) Put(key, value []byte, actionFunc ...func(action *Action)) {
+	var action Action
+
+	for _, fn := range actionFunc {
+		fn(&action)
+	}
+
+	item := NewItem(append([]byte(nil), key...), append([]byte(nil), value...), 0)
+	item.ExpireTime = action.expireTime()
+
+	b.items = append(b.items, item)
+}
+
+// Delete 在批量写入中删除一个键
+func (b *Batch) Delete(key []byte) {
+	item := NewItem(append([]byte(nil), key...), nil, 0)
+	item.Flag = flagTombstone
+
+	b.items = append(b.items, item)
+}
+
+// Len 返回批量写入中操作的数量
+func (b *Batch) Len() int {
+	return len(b.items)
+}
+
+// Reset 清空批量写入中的操作
+func (b *Batch) Reset() {
+	b.items = b.items[:0]
+}
+
+// WriteBatch 原子地提交批量写入中的所有操作
+func (db *DB) WriteBatch(batch *Batch) error {
+	if batch == nil || len(batch.items) == 0 {
+		return errors.New("the batch is empty")
+	}
+
+	ticket, err := db.commitBatch(batch.items)
+	if err != nil {
+		return err
+	}
+
+	return db.sync(ticket)
+}
+
+// 写入批量操作，返回本次写入的序号
+func (db *DB) commitBatch(items []*Item) (uint64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if err := db.writeBatch(items); err != nil {
+		return 0, err
+	}
+
+	return db.writes, nil
+}
+
+// 将批量写入的记录和提交标记一起追加到数据文件中并更新索引，调用者需要持有写锁
+func (db *DB) writeBatch(batch []*Item) error {
+	timestamp := uint64(time.Now().UnixNano())
+
+	// 批量写入的记录之后追加一个提交标记
+	commit := make([]byte, 4)
+	binary.LittleEndian.PutUint32(commit, uint32(len(batch)))
+
+	items := make([]*Item, 0, len(batch)+1)
+	for _, item := range batch {
+		copied := *item
+		copied.TimeStamp = timestamp
+		copied.Flag |= flagBatch
+		items = append(items, &copied)
+	}
+
+	marker := NewItem(nil, commit, timestamp)
+	marker.Flag = flagBatchCommit
+	items = append(items, marker)
+
+	recs, err := db.writeItems(items)
+	if err != nil {
+		return err
+	}
+
+	// 批量写入中的所有操作使用同一个版本号，对事务同时可见
+	db.seq++
+
+	for i, item := range batch {
+		if item.Flag&flagTombstone != 0 {
+			db.setIndex(item.Key, nil)
+			continue
+		}
+		db.setIndex(item.Key, recs[i])
+	}
+
+	return nil
+}
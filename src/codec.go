@@ -0,0 +1,90 @@
+package step
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// 用于值的序列化和反序列化
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// DefaultCodec 没有指定 Codec 时使用 BSON，和之前的版本保持一致
+var DefaultCodec Codec = BSONCodec{}
+
+// BSONCodec BSON 序列化的实现
+type BSONCodec struct{}
+
+// Marshal 序列化
+func (BSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return bson.Marshal(v)
+}
+
+// Unmarshal 反序列化
+func (BSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return bson.Unmarshal(data, v)
+}
+
+// JSONCodec JSON 序列化的实现
+type JSONCodec struct{}
+
+// Marshal 序列化
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal 反序列化
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec gob 序列化的实现，每个值单独编码，包含完整的类型信息
+type GobCodec struct{}
+
+// Marshal 序列化
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal 反序列化
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// selectCodec 优先使用调用时指定的 Codec，其次是 DB 的 Codec
+func selectCodec(codec Codec, override []Codec) Codec {
+	if len(override) > 0 && override[0] != nil {
+		return override[0]
+	}
+	if codec != nil {
+		return codec
+	}
+	return DefaultCodec
+}
+
+// Marshal 使用 DB 的 Codec 序列化 v，codec 可以为本次调用指定其他的 Codec
+func (db *DB) Marshal(v interface{}, codec ...Codec) ([]byte, error) {
+	return selectCodec(db.codec, codec).Marshal(v)
+}
+
+// Bson 将数据转换为Bson二进制，序列化失败时返回 nil，需要错误时使用 BSONCodec 或者 DB.Marshal
+func Bson(v interface{}) []byte {
+	if v == nil {
+		// ??? NIL
+		return []byte{}
+	}
+	data, err := BSONCodec{}.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
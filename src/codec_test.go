@@ -0,0 +1,31 @@
+package step
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	user := userinfo{Name: "Leon Ding", Age: 22}
+
+	for _, codec := range []Codec{BSONCodec{}, JSONCodec{}, GobCodec{}} {
+		data, err := codec.Marshal(&user)
+		if err != nil {
+			t.Fatalf("%T.Marshal() = %v", codec, err)
+		}
+
+		var got userinfo
+		if err := codec.Unmarshal(data, &got); err != nil || !reflect.DeepEqual(got, user) {
+			t.Errorf("%T.Unmarshal(Marshal(%v)) = %v, %v", codec, user, got, err)
+		}
+
+		// 错误的数据返回错误
+		if err := codec.Unmarshal([]byte("\x01not encoded"), &got); err == nil {
+			t.Errorf("%T.Unmarshal() of invalid data returned no error", codec)
+		}
+	}
+
+	if _, err := (JSONCodec{}).Marshal(func() {}); err == nil {
+		t.Error("JSONCodec.Marshal() of a func returned no error")
+	}
+}
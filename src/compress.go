@@ -0,0 +1,280 @@
+package step
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+)
+
+// errCorrupt 压缩的数据不完整或者格式错误
+var errCorrupt = errors.New("corrupted compressed data")
+
+// CompressionType 数据压缩使用的算法，保存在每条记录的标志位中
+type CompressionType uint8
+
+const (
+	// NoCompression 不压缩数据
+	NoCompression CompressionType = iota
+	// FlateCompression DEFLATE 压缩
+	FlateCompression
+	// GzipCompression gzip 压缩
+	GzipCompression
+	// LZCompression 格式参考 Snappy 的 LZ77 压缩，速度快但是压缩率较低
+	LZCompression
+	// DictCompression 使用从已有数据中训练的共享字典进行 DEFLATE 压缩，适合大量相似的小数据
+	// 合并数据时训练字典，在此之前使用不带字典的 DEFLATE
+	DictCompression
+)
+
+// defaultCompressThreshold 默认的压缩阈值，更小的值压缩后通常不会变小
+const defaultCompressThreshold = 128
+
+// 用于数据压缩解压
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// compressor 返回压缩算法的实现，不支持的算法和依赖字典的算法返回 nil
+func (t CompressionType) compressor() Compressor {
+	switch t {
+	case FlateCompression:
+		return FlateCompressor{Level: flate.DefaultCompression}
+	case GzipCompression:
+		return GzipCompressor{Level: gzip.DefaultCompression}
+	case LZCompression:
+		return LZCompressor{}
+	}
+	return nil
+}
+
+// FlateCompressor DEFLATE 压缩的实现
+type FlateCompressor struct {
+	Level int
+}
+
+// Compress 压缩数据
+func (c FlateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress 解压数据
+func (FlateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// GzipCompressor gzip 压缩的实现
+type GzipCompressor struct {
+	Level int
+}
+
+// Compress 压缩数据
+func (c GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress 解压数据
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// LZCompressor LZ77 压缩的实现，只在 64KB 的窗口内查找重复的数据
+// | LEN uvarint | ELEMENT ... | 每个元素以标签字节开头，低 2 位表示类型
+// 00 字面量，长度减一保存在高 6 位，60~63 表示之后 1~4 字节保存长度减一
+// 01 复制，长度 4~11，偏移值 11 位
+// 10 复制，长度 1~64，偏移值 2 字节
+// 11 复制，长度 1~64，偏移值 4 字节
+type LZCompressor struct{}
+
+const (
+	lzTagLiteral = 0x00
+	lzTagCopy1   = 0x01
+	lzTagCopy2   = 0x02
+	lzTagCopy4   = 0x03
+
+	// lzTableBits 查找重复数据的哈希表大小
+	lzTableBits = 14
+	// lzMaxOffset 复制的最大偏移值
+	lzMaxOffset = 1 << 16
+)
+
+// Compress 压缩数据
+func (LZCompressor) Compress(data []byte) ([]byte, error) {
+	dst := make([]byte, binary.MaxVarintLen64, len(data)+len(data)/60+binary.MaxVarintLen64+5)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(data)))]
+
+	var (
+		table   [1 << lzTableBits]int32
+		literal int
+	)
+
+	for i := 0; i+4 <= len(data); {
+		v := binary.LittleEndian.Uint32(data[i:])
+		h := (v * 0x1e35a7bd) >> (32 - lzTableBits)
+
+		// 哈希表中保存位置加一，零值表示没有记录
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || i-candidate >= lzMaxOffset || binary.LittleEndian.Uint32(data[candidate:]) != v {
+			i++
+			continue
+		}
+
+		n := 4
+		for i+n < len(data) && data[candidate+n] == data[i+n] {
+			n++
+		}
+
+		dst = lzLiteral(dst, data[literal:i])
+		dst = lzCopy(dst, i-candidate, n)
+
+		i += n
+		literal = i
+	}
+
+	return lzLiteral(dst, data[literal:]), nil
+}
+
+// lzLiteral 追加字面量
+func lzLiteral(dst, literal []byte) []byte {
+	n := len(literal) - 1
+	switch {
+	case n < 0:
+		return dst
+	case n < 60:
+		dst = append(dst, byte(n)<<2|lzTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|lzTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|lzTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|lzTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|lzTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+// lzCopy 追加复制，较长的重复数据拆分为多个复制
+func lzCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|lzTagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// Decompress 解压数据，数据不完整或者格式错误时返回 errCorrupt
+func (LZCompressor) Decompress(data []byte) ([]byte, error) {
+	size, k := binary.Uvarint(data)
+	// 每个字节最多解压出 64 字节，避免按照错误的长度申请内存
+	if k <= 0 || size > uint64(len(data))*64 {
+		return nil, errCorrupt
+	}
+
+	dst := make([]byte, 0, size)
+
+	for s := k; s < len(data); {
+		var (
+			tag            = data[s]
+			length, offset int
+		)
+		s++
+
+		switch tag & 0x03 {
+		case lzTagLiteral:
+			length = int(tag >> 2)
+			if length >= 60 {
+				n := length - 59
+				if s+n > len(data) {
+					return nil, errCorrupt
+				}
+				length = 0
+				for i := n - 1; i >= 0; i-- {
+					length = length<<8 | int(data[s+i])
+				}
+				s += n
+			}
+			length++
+			if length <= 0 || length > len(data)-s || uint64(len(dst)+length) > size {
+				return nil, errCorrupt
+			}
+			dst = append(dst, data[s:s+length]...)
+			s += length
+			continue
+		case lzTagCopy1:
+			if s+1 > len(data) {
+				return nil, errCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(data[s])
+			s++
+		case lzTagCopy2:
+			if s+2 > len(data) {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(data[s:]))
+			s += 2
+		case lzTagCopy4:
+			if s+4 > len(data) {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(data[s:]))
+			s += 4
+		}
+
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > size {
+			return nil, errCorrupt
+		}
+
+		// 偏移值小于长度时复制的数据相互重叠，需要逐字节复制
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if uint64(len(dst)) != size {
+		return nil, errCorrupt
+	}
+
+	return dst, nil
+}
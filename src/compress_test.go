@@ -0,0 +1,83 @@
+package step
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabcabc"),
+		bytes.Repeat([]byte("step"), 10000),
+		random,
+		Bson(map[string]interface{}{"name": "step", "tags": []string{"kv", "kv", "kv", "kv"}}),
+	}
+
+	for _, codec := range []CompressionType{FlateCompression, GzipCompression, LZCompression} {
+		compressor := codec.compressor()
+		for _, input := range inputs {
+			data, err := compressor.Compress(input)
+			if err != nil {
+				t.Fatalf("%T.Compress() = %v", compressor, err)
+			}
+			got, err := compressor.Decompress(data)
+			if err != nil || !bytes.Equal(got, input) {
+				t.Errorf("%T.Decompress(Compress(%d bytes)) = %d bytes, %v", compressor, len(input), len(got), err)
+			}
+		}
+	}
+
+	// 错误的数据不会导致 panic
+	data, _ := LZCompressor{}.Compress(bytes.Repeat([]byte("step"), 100))
+	for i := 0; i < len(data); i++ {
+		if _, err := (LZCompressor{}).Decompress(data[:i]); err == nil {
+			t.Errorf("LZCompressor.Decompress(%d of %d bytes) succeeded", i, len(data))
+		}
+	}
+	for _, input := range [][]byte{{0xff}, {10, 0x02, 0x05, 0x00}, {4, 0xfd, 0xff, 0xff, 0xff, 0xff}} {
+		if _, err := (LZCompressor{}).Decompress(input); err == nil {
+			t.Errorf("LZCompressor.Decompress(%v) succeeded", input)
+		}
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 100; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user%d@example.com","active":true}`, i, i, i)))
+	}
+
+	dict := trainDictionary(samples, 1024)
+	if len(dict) == 0 || len(dict) > 1024 {
+		t.Fatalf("len(trainDictionary()) = %d", len(dict))
+	}
+
+	value := []byte(`{"id":1000,"name":"user-1000","email":"user1000@example.com","active":true}`)
+	plain, err := FlateCompressor{Level: flate.DefaultCompression}.Compress(value)
+	checkErr(t, err)
+
+	compressor := DictCompressor{ID: 7, Dict: dict}
+	data, err := compressor.Compress(value)
+	checkErr(t, err)
+	if len(data) >= len(plain) {
+		t.Errorf("len(DictCompressor.Compress()) = %d, want less than %d without a dictionary", len(data), len(plain))
+	}
+
+	got, err := compressor.Decompress(data)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Errorf("DictCompressor.Decompress() = %q, %v", got, err)
+	}
+
+	// 字典标识符不匹配
+	if _, err := (DictCompressor{ID: 8, Dict: dict}).Decompress(data); err == nil {
+		t.Error("DictCompressor.Decompress() accepted data of another dictionary")
+	}
+}
@@ -0,0 +1,490 @@
+package step
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// dictsFileName 数据目录中保存压缩字典的文件
+const dictsFileName = "dicts"
+
+// dictMagic 压缩字典文件的魔数
+var dictMagic = []byte("STPZ")
+
+const (
+	// dictMaxSize 字典的最大长度，DEFLATE 只能引用 32KB 以内的数据
+	dictMaxSize = 32 << 10
+	// dictSampleCount 训练字典时最多采样的记录数量
+	dictSampleCount = 1024
+	// dictSampleSize 每条记录最多采样的长度
+	dictSampleSize = 1024
+	// dictMinSamples 样本少于该数量时不训练字典
+	dictMinSamples = 16
+	// dictRetrainSamples 已经有字典时，样本不少于该数量才重新训练
+	dictRetrainSamples = dictSampleCount / 4
+	// dictRetrainGain 新的字典压缩样本的长度不超过当前字典的该比例时才替换当前字典
+	dictRetrainGain = 0.9
+	// dictSegmentSize 字典由样本中的片段组成
+	dictSegmentSize = 32
+	// defaultDictThreshold 使用字典压缩时默认的压缩阈值
+	defaultDictThreshold = 16
+)
+
+// DictCompressor 使用共享字典的 DEFLATE 压缩
+// | DICT ID 4 | DEFLATE ? |
+type DictCompressor struct {
+	ID   uint32
+	Dict []byte
+}
+
+// Compress 压缩数据
+func (c DictCompressor) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 4))
+	binary.LittleEndian.PutUint32(buf.Bytes(), c.ID)
+
+	// 默认的压缩级别对很短的数据几乎不查找重复，小数据使用最高的压缩级别代价很小
+	w, err := flate.NewWriterDict(buf, flate.BestCompression, c.Dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress 解压数据
+func (c DictCompressor) Decompress(data []byte) ([]byte, error) {
+	if len(data) < 4 || binary.LittleEndian.Uint32(data[:4]) != c.ID {
+		return nil, errCorrupt
+	}
+	r := flate.NewReaderDict(bytes.NewReader(data[4:]), c.Dict)
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// dictionaries 所有的压缩字典，最后加入的字典用于压缩新的记录
+type dictionaries struct {
+	mu      sync.RWMutex
+	current uint32
+	dicts   map[uint32][]byte
+
+	// 不再是当前字典的字典可能被引用的最大的文件标识符
+	retired map[uint32]dictFiles
+}
+
+// dictFiles 数据文件和值日志文件的标识符
+type dictFiles struct {
+	data, vlog int64
+}
+
+// newDictionaries 创建空的字典集合
+func newDictionaries() *dictionaries {
+	return &dictionaries{dicts: make(map[uint32][]byte), retired: make(map[uint32]dictFiles)}
+}
+
+// compressor 返回使用当前字典的压缩实现，还没有字典时使用不带字典的 DEFLATE
+func (d *dictionaries) compressor() (Compressor, CompressionType) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if dict, ok := d.dicts[d.current]; ok {
+		return DictCompressor{ID: d.current, Dict: dict}, DictCompression
+	}
+	return FlateCompression.compressor(), FlateCompression
+}
+
+// dict 返回指定标识符的字典
+func (d *dictionaries) dict(id uint32) ([]byte, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	dict, ok := d.dicts[id]
+	return dict, ok
+}
+
+// currentDict 返回当前字典，还没有字典时返回 nil
+func (d *dictionaries) currentDict() []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.dicts[d.current]
+}
+
+// add 加入新的字典并将它作为当前字典
+func (d *dictionaries) add(id uint32, dict []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dicts[id] = dict
+	d.current = id
+}
+
+// replace 加入新的字典作为当前字典，之前的当前字典只可能被 files 以内的文件引用
+func (d *dictionaries) replace(id uint32, dict []byte, files dictFiles) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.dicts[d.current]; ok {
+		d.retired[d.current] = files
+	}
+	d.dicts[id] = dict
+	d.current = id
+}
+
+// prune 移除只可能被 oldest 之前的文件引用的旧字典，返回是否有字典被移除
+// 从数据目录中加载的旧字典没有记录，第一次检查时记为可能被 latest 以内的文件引用
+func (d *dictionaries) prune(oldest, latest dictFiles) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var removed bool
+	for id := range d.dicts {
+		if id == d.current {
+			continue
+		}
+		files, ok := d.retired[id]
+		if !ok {
+			d.retired[id] = latest
+			continue
+		}
+		if files.data < oldest.data && files.vlog < oldest.vlog {
+			delete(d.dicts, id)
+			delete(d.retired, id)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// all 返回所有字典的副本
+func (d *dictionaries) all() map[uint32][]byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	dicts := make(map[uint32][]byte, len(d.dicts)+1)
+	for id, dict := range d.dicts {
+		dicts[id] = dict
+	}
+	return dicts
+}
+
+// next 返回下一个字典的标识符
+func (d *dictionaries) next() uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.dicts) == 0 {
+		return 0
+	}
+	return d.current + 1
+}
+
+// decompressDict 使用记录中标识符对应的字典解压
+func (e *Encoder) decompressDict(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errCorrupt
+	}
+
+	id := binary.LittleEndian.Uint32(data[:4])
+	dict, ok := e.dicts.dict(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown compression dictionary %d", id)
+	}
+
+	return DictCompressor{ID: id, Dict: dict}.Decompress(data)
+}
+
+// trainDictionary 从样本中训练压缩字典
+// 统计每个 8 字节片段出现在多少个样本中，选出包含最多公共片段的样本片段组成字典
+func trainDictionary(samples [][]byte, size int) []byte {
+	const k = 8
+
+	freq := make(map[uint64]int)
+	for _, sample := range samples {
+		seen := make(map[uint64]bool)
+		for i := 0; i+k <= len(sample); i++ {
+			seen[binary.LittleEndian.Uint64(sample[i:])] = true
+		}
+		for kmer := range seen {
+			freq[kmer]++
+		}
+	}
+
+	type segment struct {
+		data  []byte
+		score int
+	}
+
+	var segments []segment
+	for _, sample := range samples {
+		for i := 0; i < len(sample); i += dictSegmentSize {
+			end := i + dictSegmentSize
+			if end > len(sample) {
+				end = len(sample)
+			}
+
+			// 只出现在一个样本中的片段对其他记录没有帮助
+			var score int
+			for j := i; j+k <= end; j++ {
+				if n := freq[binary.LittleEndian.Uint64(sample[j:])]; n > 1 {
+					score += n
+				}
+			}
+			if score > 0 {
+				segments = append(segments, segment{data: sample[i:end], score: score})
+			}
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].score > segments[j].score })
+
+	var (
+		chosen [][]byte
+		total  int
+		used   = make(map[string]bool)
+	)
+
+	for _, seg := range segments {
+		if used[string(seg.data)] || total+len(seg.data) > size {
+			continue
+		}
+		used[string(seg.data)] = true
+		chosen = append(chosen, seg.data)
+		total += len(seg.data)
+	}
+
+	// 越靠近字典末尾的数据引用距离越短，得分最高的片段放在最后
+	dict := make([]byte, 0, total)
+	for i := len(chosen) - 1; i >= 0; i-- {
+		dict = append(dict, chosen[i]...)
+	}
+
+	return dict
+}
+
+// trainMergeDictionary 使用字典压缩时，从参与合并的记录中采样训练字典
+// 已经有字典时，样本足够多并且新的字典明显更好才替换，新的字典使用新的标识符，旧的字典保留到没有记录引用为止
+// 字典落盘之后才会用于压缩合并写入的记录
+func (db *DB) trainMergeDictionary(plan *mergePlan) error {
+	if db.encoder.compression != DictCompression {
+		return nil
+	}
+
+	min := dictMinSamples
+	if len(db.encoder.dicts.all()) > 0 {
+		min = dictRetrainSamples
+	}
+	if len(plan.records) < min {
+		return nil
+	}
+
+	var (
+		samples [][]byte
+		step    = len(plan.records)/dictSampleCount + 1
+	)
+
+	for i := 0; i < len(plan.records); i += step {
+		db.mutex.RLock()
+		item, err := db.encoder.Read(plan.records[i], db.fileList)
+		db.mutex.RUnlock()
+
+		if err != nil {
+			return err
+		}
+
+		// 值日志的指针不是记录的值
+		if item.Flag&flagValuePointer != 0 {
+			continue
+		}
+
+		if len(item.Value) > dictSampleSize {
+			item.Value = item.Value[:dictSampleSize]
+		}
+		samples = append(samples, item.Value)
+	}
+
+	if len(samples) < min {
+		return nil
+	}
+
+	dict := trainDictionary(samples, dictMaxSize)
+	if len(dict) == 0 {
+		return nil
+	}
+
+	if current := db.encoder.dicts.currentDict(); current != nil {
+		before, err := compressedSize(samples, current)
+		if err != nil {
+			return err
+		}
+		after, err := compressedSize(samples, dict)
+		if err != nil {
+			return err
+		}
+		if float64(after) > float64(before)*dictRetrainGain {
+			return nil
+		}
+	}
+
+	id, dicts := db.encoder.dicts.next(), db.encoder.dicts.all()
+	dicts[id] = dict
+	if err := db.writeDictionaries(dicts); err != nil {
+		return err
+	}
+
+	// 写入记录时持有写锁，切换字典之后新的记录只会写入更新的文件
+	db.mutex.Lock()
+	db.encoder.dicts.replace(id, dict, dictFiles{data: db.dataFileVersion, vlog: db.vlog.fid})
+	db.mutex.Unlock()
+
+	return nil
+}
+
+// pruneDictionaries 移除已经没有文件可能引用的旧字典并重新写入字典文件，调用者需要持有写锁
+func (db *DB) pruneDictionaries() error {
+	oldest := dictFiles{data: math.MaxInt64, vlog: math.MaxInt64}
+	for fid := range db.fileList {
+		if fid < oldest.data {
+			oldest.data = fid
+		}
+	}
+	for fid := range db.vlog.files {
+		if fid < oldest.vlog {
+			oldest.vlog = fid
+		}
+	}
+
+	latest := dictFiles{data: db.dataFileVersion, vlog: db.vlog.fid}
+	if !db.encoder.dicts.prune(oldest, latest) {
+		return nil
+	}
+
+	return db.writeDictionaries(db.encoder.dicts.all())
+}
+
+// byteCounter 只统计写入的长度
+type byteCounter int
+
+// Write 统计写入的长度
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// compressedSize 返回使用字典分别压缩每个样本之后的总长度
+func compressedSize(samples [][]byte, dict []byte) (int, error) {
+	var n byteCounter
+
+	w, err := flate.NewWriterDict(&n, flate.BestCompression, dict)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, sample := range samples {
+		w.Reset(&n)
+		if _, err := w.Write(sample); err != nil {
+			return 0, err
+		}
+		if err := w.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(n), nil
+}
+
+// loadDictionaries 读取数据目录中的压缩字典
+// | MAGIC 4 | VERSION 2 | FLAGS 2 | 之后每一项为 | CRC 4 | ID 4 | LEN 4 | DICT ? |
+// 启用加密时字典包含记录中的数据，需要和记录一样加密
+func (db *DB) loadDictionaries() error {
+	data, err := ioutil.ReadFile(db.root + dictsFileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	name := db.root + dictsFileName
+
+	if len(data) < fileHeaderSize || !bytes.Equal(data[:4], dictMagic) || binary.LittleEndian.Uint16(data[4:6]) != currentFormat {
+		return fmt.Errorf("%s is not a valid dictionary file", name)
+	}
+
+	flags := binary.LittleEndian.Uint16(data[6:8])
+	if flags&^fileSealed != 0 {
+		return fmt.Errorf("%s uses unsupported feature flags %#x", name, flags&^fileSealed)
+	}
+	if flags&fileSealed != 0 && !db.encoder.enable {
+		return fmt.Errorf("%s is encrypted but encryption is not enabled", name)
+	}
+
+	for data = data[fileHeaderSize:]; len(data) > 0; {
+		if len(data) < 12 || len(data)-12 < int(binary.LittleEndian.Uint32(data[8:12])) {
+			return fmt.Errorf("%s is incomplete", name)
+		}
+
+		var (
+			end  = 12 + int(binary.LittleEndian.Uint32(data[8:12]))
+			id   = binary.LittleEndian.Uint32(data[4:8])
+			dict = data[12:end]
+		)
+
+		if binary.LittleEndian.Uint32(data[:4]) != crc32.ChecksumIEEE(data[4:end]) {
+			return fmt.Errorf("%s is corrupted", name)
+		}
+
+		if flags&fileSealed != 0 {
+			if dict, err = db.encoder.unseal(dict, dictMagic); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		db.encoder.dicts.add(id, dict)
+		data = data[end:]
+	}
+
+	return nil
+}
+
+// writeDictionaries 写入所有的字典，先写入临时文件再重命名
+// 启用加密时使用当前密钥加密，轮换密钥之后需要重新写入
+func (db *DB) writeDictionaries(dicts map[uint32][]byte) error {
+	var flags uint16
+	if db.encoder.enable {
+		flags = fileSealed
+	}
+
+	ids := make([]uint32, 0, len(dicts))
+	for id := range dicts {
+		ids = append(ids, id)
+	}
+	// 标识符最大的字典是当前字典，读取时最后加入
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	buf := fileHeader(dictMagic, flags)
+
+	for _, id := range ids {
+		dict := dicts[id]
+		if flags&fileSealed != 0 {
+			var err error
+			if dict, err = db.encoder.seal(dict, dictMagic); err != nil {
+				return err
+			}
+		}
+
+		entry := make([]byte, 12+len(dict))
+		binary.LittleEndian.PutUint32(entry[4:8], id)
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(len(dict)))
+		copy(entry[12:], dict)
+		binary.LittleEndian.PutUint32(entry[:4], crc32.ChecksumIEEE(entry[4:]))
+		buf = append(buf, entry...)
+	}
+
+	return writeFileAtomic(db.root+dictsFileName, buf)
+}
@@ -3,60 +3,228 @@ package step
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
-	"time"
+)
+
+// errTornRecord 数据文件中存在不完整或者校验失败的记录
+var errTornRecord = errors.New("torn or corrupted data record")
+
+const (
+	// flagTombstone 删除标记，表示记录的键已经被删除
+	flagTombstone uint8 = 1 << iota
+	// flagBatch 批量写入中的记录，只有读取到提交标记后才会生效
+	flagBatch
+	// flagBatchCommit 批量写入的提交标记，值为批量写入中记录的数量
+	flagBatchCommit
+)
+
+// flagValuePointer 记录的值保存在值日志中，数据文件中的值是指向它的指针
+const flagValuePointer uint8 = 1 << 6
+
+// flagStream 流式写入的记录，单独使用时表示值日志中的数据块，和 flagValuePointer 一起使用时表示数据文件中的清单
+const flagStream uint8 = 1 << 7
+
+// 记录的值使用的压缩算法保存在标志位的第 3~5 位，零值表示没有压缩
+const (
+	flagCodecShift       = 3
+	flagCodecMask  uint8 = 0x07 << flagCodecShift
 )
 
 // 数据编码器
 type Encoder struct {
-	Encryptor      // 加密的具体实现
-	enable    bool // 是否启用加密解密
+	Encryptor            // 加密的具体实现
+	enable    bool       // 是否启用加密解密
+	keyring   *keyring   // 加密密钥环
+	cipher    CipherType // 写入时使用的加密算法
+	full      bool       // 是否整体加密记录和提示文件，包括键和元数据
+
+	compression CompressionType // 写入时使用的压缩算法
+	threshold   int             // 小于该长度的值不压缩
+	dicts       *dictionaries   // 数据目录中的压缩字典
 }
 
 // 启用 AES 加密
-func AES() *Encoder {
+func AES(secret []byte) *Encoder {
 	return &Encoder{
 		enable:    true,
+		keyring:   newKeyring(0, map[uint32][]byte{0: secret}),
+		cipher:    AESCBC,
 		Encryptor: new(AESEncryptor),
 	}
 }
 
+// GCM 启用 AES-GCM 认证加密
+func GCM(secret []byte) *Encoder {
+	return &Encoder{
+		enable:    true,
+		keyring:   newKeyring(0, map[uint32][]byte{0: secret}),
+		cipher:    AESGCM,
+		Encryptor: new(GCMEncryptor),
+	}
+}
+
 // Write 将 item 写入当前激活文件中
 func (e *Encoder) Write(item *Item, file *os.File) (int, error) {
-	// 是否开启加密
-	if e.enable && e.Encryptor != nil {
+	buf, err := e.encode(item)
+	if err != nil {
+		return 0, err
+	}
+	return bufToFile(buf, file)
+}
+
+// encode 将 item 编码为写入数据文件的二进制数据
+func (e *Encoder) encode(item *Item) ([]byte, error) {
+	// 先压缩再加密，加密后的数据无法压缩
+	if err := e.compress(item); err != nil {
+		return nil, err
+	}
+
+	// 整体加密时键、值和元数据一起加密，删除标记和提交标记也不例外
+	if e.enable && e.full {
+		data, err := e.seal(binaryEncode(item), dataMagic)
+		if err != nil {
+			return nil, errors.New("an error occurred in the encryption encoder")
+		}
+		// | LEN 4 | SEALED RECORD ? |
+		buf := make([]byte, 4+len(data))
+		binary.LittleEndian.PutUint32(buf[:4], uint32(len(data)))
+		copy(buf[4:], data)
+		return buf, nil
+	}
+
+	// 是否开启加密，删除标记和提交标记不需要加密
+	if e.enable && e.Encryptor != nil && item.Flag&(flagTombstone|flagBatchCommit) == 0 {
+		id, key := e.keyring.currentKey()
 		// building source data
 		sd := &SourceData{
-			Secret: Secret,
-			Data:   item.Value,
+			Secret:         key,
+			Data:           item.Value,
+			AdditionalData: item.Key,
 		}
 		if err := e.Encode(sd); err != nil {
-			return 0, errors.New("an error occurred in the encryption encoder")
+			return nil, errors.New("an error occurred in the encryption encoder")
 		}
-		item.Value = sd.Data
-		return bufToFile(binaryEncode(item), file)
+		// | KEY ID 4 | ENCRYPTED VALUE ? |
+		item.Value = make([]byte, 4+len(sd.Data))
+		binary.LittleEndian.PutUint32(item.Value[:4], id)
+		copy(item.Value[4:], sd.Data)
+	}
+
+	return binaryEncode(item), nil
+}
+
+// compress 压缩 item 的值并在标志位中记录压缩算法，压缩后没有变小时保留原来的值
+func (e *Encoder) compress(item *Item) error {
+	compressor, codec := e.compression.compressor(), e.compression
+	if codec == DictCompression {
+		compressor, codec = e.dicts.compressor()
+	}
+
+	// 删除标记、提交标记和值日志的指针不需要压缩
+	if compressor == nil || len(item.Value) < e.threshold || item.Flag&(flagTombstone|flagBatchCommit|flagValuePointer) != 0 {
+		return nil
+	}
+
+	data, err := compressor.Compress(item.Value)
+	if err != nil {
+		return fmt.Errorf("an error occurred in the compressor: %w", err)
+	}
+
+	if len(data) < len(item.Value) {
+		item.Value = data
+		item.Flag |= uint8(codec) << flagCodecShift
+	}
+
+	return nil
+}
+
+// decompress 按照标志位中记录的压缩算法解压 item 的值
+func (e *Encoder) decompress(item *Item) error {
+	var (
+		codec = CompressionType(item.Flag & flagCodecMask >> flagCodecShift)
+		value []byte
+		err   error
+	)
+
+	switch compressor := codec.compressor(); {
+	case codec == NoCompression:
+		return nil
+	case codec == DictCompression:
+		value, err = e.decompressDict(item.Value)
+	case compressor == nil:
+		return fmt.Errorf("unsupported compression type %d", codec)
+	default:
+		value, err = compressor.Decompress(item.Value)
+	}
+
+	if err != nil {
+		return fmt.Errorf("a data decompression error occurred: %w", err)
 	}
 
-	return bufToFile(binaryEncode(item), file)
+	// 解压后的 item 重新写入时按照当前的选项压缩
+	item.Value = value
+	item.Flag &^= flagCodecMask
+	return nil
 }
 
-func (e *Encoder) Read(rec *record) (*Item, error) {
+// Read 从 record 指向的数据文件中读取 item，并解密和解压它的值
+func (e *Encoder) Read(rec *record, fileList map[int64]*dataFile) (*Item, error) {
+	item, err := e.read(rec, fileList)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.decompress(item); err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// read 从 record 指向的数据文件中读取 item 并解密
+func (e *Encoder) read(rec *record, fileList map[int64]*dataFile) (*Item, error) {
+	if file, ok := fileList[rec.FID]; ok && file.flags&fileSealed != 0 {
+		return e.readSealedRecord(rec, file)
+	}
+
 	// Parse to data entities
-	item, err := parseLog(rec)
+	item, err := parseLog(rec, fileList)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if e.enable && e.Encryptor != nil && item != nil {
+	if e.enable && e.Encryptor != nil {
+		var (
+			flags = fileList[rec.FID].flags
+			id    uint32
+			data  = item.Value
+		)
+
+		// 没有记录密钥标识符的旧数据文件使用标识符为 0 的密钥
+		if flags&fileKeyID != 0 {
+			if len(data) < 4 {
+				return nil, fmt.Errorf("a data decryption error occurred: %w", ErrTampered)
+			}
+			id, data = binary.LittleEndian.Uint32(data[:4]), data[4:]
+		}
+
+		key, ok := e.keyring.key(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown encryption key %d", id)
+		}
+
 		// Decryption operation
 		sd := &SourceData{
-			Secret: Secret,
-			Data:   item.Value,
+			Secret:         key,
+			Data:           data,
+			AdditionalData: item.Key,
 		}
-		if err := e.Decode(sd); err != nil {
-			return nil, errors.New("a data decryption error occurred")
+		if err := e.decryptor(flags).Decode(sd); err != nil {
+			return nil, fmt.Errorf("a data decryption error occurred: %w", err)
 		}
 		item.Value = sd.Data
 		return item, nil
@@ -65,68 +233,149 @@ func (e *Encoder) Read(rec *record) (*Item, error) {
 	return item, nil
 }
 
+// readSealedRecord 读取并解密整体加密的记录
+func (e *Encoder) readSealedRecord(rec *record, file *dataFile) (*Item, error) {
+	data := make([]byte, rec.Size)
+	if _, err := file.ReadAt(data, rec.Offset); err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, errTornRecord
+	}
+
+	plain, err := e.unseal(data[4:], dataMagic)
+	if err != nil {
+		return nil, fmt.Errorf("a data decryption error occurred: %w", err)
+	}
+
+	if item := binaryDecode(plain); item != nil {
+		return item, nil
+	}
+	return nil, errTornRecord
+}
+
+// seal 使用当前密钥和 AES-GCM 加密整条记录或者整个提示文件，magic 作为附加认证数据区分两者
+// | KEY ID 4 | NONCE 12 | CIPHERTEXT ? | TAG 16 |
+func (e *Encoder) seal(data, magic []byte) ([]byte, error) {
+	id, key := e.keyring.currentKey()
+
+	sd := &SourceData{Secret: key, Data: data, AdditionalData: magic}
+	if err := (GCMEncryptor{}).Encode(sd); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4+len(sd.Data))
+	binary.LittleEndian.PutUint32(buf[:4], id)
+	copy(buf[4:], sd.Data)
+	return buf, nil
+}
+
+// unseal 解密 seal 加密的数据，密钥错误或者数据被篡改时返回 ErrTampered
+func (e *Encoder) unseal(data, magic []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, ErrTampered
+	}
+
+	id := binary.LittleEndian.Uint32(data[:4])
+	key, ok := e.keyring.key(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %d", id)
+	}
+
+	sd := &SourceData{Secret: key, Data: data[4:], AdditionalData: magic}
+	if err := (GCMEncryptor{}).Decode(sd); err != nil {
+		return nil, err
+	}
+	return sd.Data, nil
+}
+
+// decryptor 按照数据文件头中记录的算法解密，旧的数据文件使用 AES-CBC
+// 合并数据时旧算法加密的数据会使用当前的算法重新加密
+func (e *Encoder) decryptor(flags uint16) Encryptor {
+	if flags&fileAESGCM != 0 {
+		return GCMEncryptor{}
+	}
+	return AESEncryptor{}
+}
+
+// indexPadding 索引项编码头的长度
+const indexPadding = 45
+
 // WriteIndex 文件的索引项
-func (Encoder) WriteIndex(item indexItem, file *os.File) (int, error) {
-	// | CRC32 4 | IDX 8 | FID 8  | TS 4 | ET 4 | SZ 4 | OF 4 |
-	buf := make([]byte, 36)
-
-	binary.LittleEndian.PutUint64(buf[4:12], item.idx)
-	binary.LittleEndian.PutUint64(buf[12:20], uint64(item.FID))
-	binary.LittleEndian.PutUint32(buf[20:24], item.Timestamp)
-	binary.LittleEndian.PutUint32(buf[24:28], item.ExpireTime)
+func (Encoder) WriteIndex(item indexItem, w io.Writer) (int, error) {
+	// | CRC32 4 | FID 8 | TS 8 | ET 8 | SZ 4 | OF 8 | FG 1 | KS 4 | KEY ? |
+	buf := make([]byte, indexPadding+len(item.Key))
+
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(item.FID))
+	binary.LittleEndian.PutUint64(buf[12:20], item.Timestamp)
+	binary.LittleEndian.PutUint64(buf[20:28], item.ExpireTime)
 	binary.LittleEndian.PutUint32(buf[28:32], item.Size)
-	binary.LittleEndian.PutUint32(buf[32:36], item.Offset)
+	binary.LittleEndian.PutUint64(buf[32:40], uint64(item.Offset))
+	buf[40] = item.flag
+	binary.LittleEndian.PutUint32(buf[41:45], uint32(len(item.Key)))
+	copy(buf[indexPadding:], item.Key)
 
 	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
 
-	return file.Write(buf)
+	return w.Write(buf)
 }
 
-// ReadIndex 读取文件的索引
-func (Encoder) ReadIndex(buf []byte) error {
+// ReadIndex 读取文件的索引，读取到文件末尾时返回 io.EOF
+func (Encoder) ReadIndex(r io.Reader) (*indexItem, error) {
 	var (
 		item indexItem
+		buf  = make([]byte, indexPadding)
 	)
 
-	if binary.LittleEndian.Uint32(buf[:4]) != crc32.ChecksumIEEE(buf[4:]) {
-		return errors.New("index record verification failed")
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.New("index record is incomplete")
 	}
 
 	item.record = new(record)
+	item.Key = make([]byte, binary.LittleEndian.Uint32(buf[41:45]))
 
-	item.idx = binary.LittleEndian.Uint64(buf[4:12])
-	item.FID = int64(binary.LittleEndian.Uint64(buf[12:20]))
-	item.Timestamp = binary.LittleEndian.Uint32(buf[20:24])
-	item.ExpireTime = binary.LittleEndian.Uint32(buf[24:28])
-	item.Size = binary.LittleEndian.Uint32(buf[28:32])
-	item.Offset = binary.LittleEndian.Uint32(buf[32:36])
+	if _, err := io.ReadFull(r, item.Key); err != nil {
+		return nil, errors.New("index record is incomplete")
+	}
 
-	// Determine expiration date
-	if uint32(time.Now().Unix()) <= item.ExpireTime {
-		index[item.idx] = &record{
-			FID:        item.FID,
-			Size:       item.Size,
-			Offset:     item.Offset,
-			Timestamp:  item.Timestamp,
-			ExpireTime: item.ExpireTime,
-		}
+	checksum := crc32.Update(crc32.ChecksumIEEE(buf[4:]), crc32.IEEETable, item.Key)
+	if binary.LittleEndian.Uint32(buf[:4]) != checksum {
+		return nil, errors.New("index record verification failed")
 	}
 
-	return nil
+	item.FID = int64(binary.LittleEndian.Uint64(buf[4:12]))
+	item.Timestamp = binary.LittleEndian.Uint64(buf[12:20])
+	item.ExpireTime = binary.LittleEndian.Uint64(buf[20:28])
+	item.Size = binary.LittleEndian.Uint32(buf[28:32])
+	item.Offset = int64(binary.LittleEndian.Uint64(buf[32:40]))
+	item.flag = buf[40]
+
+	return &item, nil
 }
 
 // parseLog 从 item 中解析数据
-func parseLog(rec *record) (*Item, error) {
+func parseLog(rec *record, fileList map[int64]*dataFile) (*Item, error) {
 	// 通过 record 找到该文件的标识符
 	if file, ok := fileList[rec.FID]; ok {
 		// 根据文件尺寸申请相应的空间
 		data := make([]byte, rec.Size)
 		// 将内读取到 data 中
-		_, err := file.ReadAt(data, int64(rec.Offset))
+		_, err := file.ReadAt(data, rec.Offset)
 		if err != nil {
 			return nil, err
 		}
-		return binaryDecode(data), nil
+		decode := binaryDecode
+		if file.version == formatV1 {
+			decode = legacyDecode
+		}
+		if item := decode(data); item != nil {
+			return item, nil
+		}
+		return nil, errTornRecord
 	}
 	return nil, errors.New("no readable data file found")
 }
@@ -134,16 +383,22 @@ func parseLog(rec *record) (*Item, error) {
 // binaryDecode 将二进制数据解析为 item
 func binaryDecode(data []byte) *Item {
 	// 检查数据是否完整
-	if binary.LittleEndian.Uint32(data[:4]) != crc32.ChecksumIEEE(data[4:]) {
+	if uint32(len(data)) < itemPadding || binary.LittleEndian.Uint32(data[:4]) != crc32.ChecksumIEEE(data[4:]) {
 		return nil
 	}
 
 	var item Item
-	// | CRC 4 | TS 8  | KS 4 | VS 4  | KEY ? | VALUE ? |
+	// | CRC 4 | TS 8 | ET 8 | KS 4 | VS 4 | FG 1 | KEY ? | VALUE ? |
 	item.CRC32 = binary.LittleEndian.Uint32(data[:4])
 	item.TimeStamp = binary.LittleEndian.Uint64(data[4:12])
-	item.KeySize = binary.LittleEndian.Uint32(data[12:16])
-	item.ValueSize = binary.LittleEndian.Uint32(data[16:20])
+	item.ExpireTime = binary.LittleEndian.Uint64(data[12:20])
+	item.KeySize = binary.LittleEndian.Uint32(data[20:24])
+	item.ValueSize = binary.LittleEndian.Uint32(data[24:28])
+	item.Flag = data[28]
+
+	if uint32(len(data)) != itemPadding+item.KeySize+item.ValueSize {
+		return nil
+	}
 
 	// 解析 log 数据
 	item.Key, item.Value = make([]byte, item.KeySize), make([]byte, item.ValueSize)
@@ -152,6 +407,169 @@ func binaryDecode(data []byte) *Item {
 	return &item
 }
 
+// readItemAt 从数据文件的指定偏移读取一条完整的记录
+// 到达文件末尾时返回 io.EOF，记录不完整或者校验失败时返回 errTornRecord
+func readItemAt(file *dataFile, offset int64) (*Item, int, error) {
+	var (
+		padding            = itemPadding
+		sizes              = itemPadding - 9
+		keySize, valueSize uint32
+		decode             = binaryDecode
+	)
+
+	if file.version == formatV1 {
+		padding, sizes, decode = legacyItemPadding, 12, legacyDecode
+	}
+
+	header := make([]byte, padding)
+
+	if n, err := file.ReadAt(header, offset); err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, 0, io.EOF
+		}
+		if err == io.EOF {
+			return nil, 0, errTornRecord
+		}
+		return nil, 0, err
+	}
+
+	// | KS 4 | VS 4 | 在编码头中的位置
+	keySize = binary.LittleEndian.Uint32(header[sizes : sizes+4])
+	valueSize = binary.LittleEndian.Uint32(header[sizes+4 : sizes+8])
+	size := int64(padding) + int64(keySize) + int64(valueSize)
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 记录的长度超出了文件的末尾
+	if offset+size > info.Size() {
+		return nil, 0, errTornRecord
+	}
+
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return nil, 0, err
+	}
+
+	item := decode(data)
+	if item == nil {
+		return nil, 0, errTornRecord
+	}
+
+	return item, int(size), nil
+}
+
+// readItemAt 从数据文件的指定偏移读取一条完整的记录，整体加密的记录先解密
+func (e *Encoder) readItemAt(file *dataFile, offset int64) (*Item, int, error) {
+	if file.flags&fileSealed == 0 {
+		return readItemAt(file, offset)
+	}
+
+	plain, size, err := e.readSealed(file, offset)
+	// 认证失败说明密钥错误或者数据被篡改，不能当作不完整的记录截断
+	if errors.Is(err, ErrTampered) {
+		return nil, 0, fmt.Errorf("%s: the record at offset %d cannot be decrypted: %w", file.Name(), offset, err)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	item := binaryDecode(plain)
+	if item == nil {
+		return nil, 0, errTornRecord
+	}
+
+	return item, size, nil
+}
+
+// tornTail 判断返回 errTornRecord 的记录是否超出了文件末尾，只有这样的记录才是异常退出时写入的不完整记录
+// 没有超出文件末尾的记录校验失败说明文件已经损坏
+func (e *Encoder) tornTail(file *dataFile, offset int64) (bool, error) {
+	// | KS 4 | VS 4 | 在编码头中的位置
+	var (
+		padding = int64(itemPadding)
+		sizes   = int64(itemPadding - 9)
+	)
+
+	switch {
+	case file.flags&fileSealed != 0:
+		padding = 4
+	case file.version == formatV1:
+		padding, sizes = legacyItemPadding, 12
+	}
+
+	header := make([]byte, padding)
+	if _, err := file.ReadAt(header, offset); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var size int64
+	if file.flags&fileSealed != 0 {
+		// 长度为 0 的记录是没有写入内容的空白区域
+		if size = 4 + int64(binary.LittleEndian.Uint32(header)); size == 4 {
+			return true, nil
+		}
+	} else {
+		size = padding + int64(binary.LittleEndian.Uint32(header[sizes:sizes+4])) + int64(binary.LittleEndian.Uint32(header[sizes+4:sizes+8]))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return offset+size > info.Size(), nil
+}
+
+// readSealed 读取并解密指定偏移的整体加密记录，返回明文和记录在文件中的长度
+// 到达文件末尾时返回 io.EOF，记录不完整时返回 errTornRecord，认证失败时返回 ErrTampered
+func (e *Encoder) readSealed(file *dataFile, offset int64) ([]byte, int, error) {
+	header := make([]byte, 4)
+
+	if n, err := file.ReadAt(header, offset); err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, 0, io.EOF
+		}
+		if err == io.EOF {
+			return nil, 0, errTornRecord
+		}
+		return nil, 0, err
+	}
+
+	size := 4 + int64(binary.LittleEndian.Uint32(header))
+
+	// 异常退出时文件末尾可能是没有写入内容的空白区域
+	if size == 4 {
+		return nil, 0, errTornRecord
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 记录的长度超出了文件的末尾
+	if offset+size > info.Size() {
+		return nil, 0, errTornRecord
+	}
+
+	data := make([]byte, size-4)
+	if _, err := file.ReadAt(data, offset+4); err != nil {
+		return nil, 0, err
+	}
+
+	plain, err := e.unseal(data, dataMagic)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return plain, int(size), nil
+}
+
 // binaryEncode 将数据 item 解析为二进制切片
 func binaryEncode(item *Item) []byte {
 	// fix bug: https://github.com/golang/go/issues/24402
@@ -160,11 +578,13 @@ func binaryEncode(item *Item) []byte {
 
 	buf := make([]byte, itemPadding+item.KeySize+item.ValueSize)
 
-	// | CRC 4 | TS 8  | KS 4 | VS 4  | KEY ? | VALUE ? |
-	// ItemPadding = 8 + 12 = 20 bit
+	// | CRC 4 | TS 8 | ET 8 | KS 4 | VS 4 | FG 1 | KEY ? | VALUE ? |
+	// ItemPadding = 4 + 16 + 8 + 1 = 29 byte
 	binary.LittleEndian.PutUint64(buf[4:12], item.TimeStamp)
-	binary.LittleEndian.PutUint32(buf[12:16], item.KeySize)
-	binary.LittleEndian.PutUint32(buf[16:20], item.ValueSize)
+	binary.LittleEndian.PutUint64(buf[12:20], item.ExpireTime)
+	binary.LittleEndian.PutUint32(buf[20:24], item.KeySize)
+	binary.LittleEndian.PutUint32(buf[24:28], item.ValueSize)
+	buf[28] = item.Flag
 
 	//buf = append(buf, item.Key...)
 	//buf = append(buf, item.Value...)
@@ -4,12 +4,36 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTampered 加密的数据没有通过完整性校验，数据被篡改或者密钥错误
+var ErrTampered = errors.New("encrypted data failed authentication")
+
+// errPadding 解密后的数据填充不合法
+var errPadding = errors.New("invalid PKCS7 padding")
+
+// CipherType 数据加密使用的算法
+type CipherType uint8
+
+const (
+	// AESGCM AES-GCM 认证加密，每条记录使用随机的 nonce，密钥长度决定使用 AES-128/192/256
+	AESGCM CipherType = iota
+	// AESCBC 旧版本使用的 AES-CBC 加密，没有完整性校验
+	AESCBC
 )
 
 // 进行加密解密的数据
 type SourceData struct {
 	Data   []byte
 	Secret []byte
+	// 附加认证数据，只参与认证不会被加密，AES-CBC 会忽略
+	AdditionalData []byte
 }
 
 // 用于数据加密解密
@@ -22,37 +46,97 @@ type Encryptor interface {
 type AESEncryptor struct{}
 
 // Encode source data encode
-func (AESEncryptor) Encode(sd *SourceData) error {
-	sd.Data = aesEncrypt(sd.Data, sd.Secret)
-	return nil
+func (AESEncryptor) Encode(sd *SourceData) (err error) {
+	sd.Data, err = aesEncrypt(sd.Data, sd.Secret)
+	return err
 }
 
 // Decode source data decode
-func (AESEncryptor) Decode(sd *SourceData) error {
-	sd.Data = aesDecrypt(sd.Data, sd.Secret)
+func (AESEncryptor) Decode(sd *SourceData) (err error) {
+	sd.Data, err = aesDecrypt(sd.Data, sd.Secret)
+	return err
+}
+
+// GCMEncryptor AES-GCM 认证加密的实现
+// | NONCE 12 | CIPHERTEXT ? | TAG 16 |
+type GCMEncryptor struct{}
+
+// Encode 使用随机的 nonce 加密数据
+func (GCMEncryptor) Encode(sd *SourceData) error {
+	aead, err := newGCM(sd.Secret)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(sd.Data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	sd.Data = aead.Seal(nonce, nonce, sd.Data, sd.AdditionalData)
 	return nil
 }
 
+// Decode 解密数据并校验完整性，校验失败时返回 ErrTampered
+func (GCMEncryptor) Decode(sd *SourceData) error {
+	aead, err := newGCM(sd.Secret)
+	if err != nil {
+		return err
+	}
+
+	if len(sd.Data) < aead.NonceSize()+aead.Overhead() {
+		return ErrTampered
+	}
+
+	nonce, ciphertext := sd.Data[:aead.NonceSize()], sd.Data[aead.NonceSize():]
+
+	data, err := aead.Open(nil, nonce, ciphertext, sd.AdditionalData)
+	if err != nil {
+		return ErrTampered
+	}
+
+	sd.Data = data
+	return nil
+}
+
+// newGCM 使用密钥创建 AES-GCM
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 // aesEncrypt ASE encode
-func aesEncrypt(origData, key []byte) []byte {
-	block, _ := aes.NewCipher(key)
+func aesEncrypt(origData, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	blockSize := block.BlockSize()
 	origData = PKCS7Padding(origData, blockSize)
 	blockMode := cipher.NewCBCEncrypter(block, key[:blockSize])
 	result := make([]byte, len(origData))
 	blockMode.CryptBlocks(result, origData)
-	return result
+	return result, nil
 }
 
 // aesDecrypt  aes decode
-func aesDecrypt(bytes, key []byte) []byte {
-	block, _ := aes.NewCipher(key)
+func aesDecrypt(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	blockSize := block.BlockSize()
+	// 密文必须是完整的分组，否则 CryptBlocks 会 panic
+	if len(data)%blockSize != 0 {
+		return nil, errPadding
+	}
 	blockMode := cipher.NewCBCDecrypter(block, key[:blockSize])
-	orig := make([]byte, len(bytes))
-	blockMode.CryptBlocks(orig, bytes)
-	orig = PKCS7UnPadding(orig)
-	return orig
+	orig := make([]byte, len(data))
+	blockMode.CryptBlocks(orig, data)
+	return PKCS7UnPadding(orig)
 }
 
 // PKCS7Padding complement
@@ -63,8 +147,133 @@ func PKCS7Padding(ciphertext []byte, blksize int) []byte {
 }
 
 // PKCS7UnPadding to the code
-func PKCS7UnPadding(origData []byte) []byte {
+// 填充不合法时返回错误，而不是越界 panic
+func PKCS7UnPadding(origData []byte) ([]byte, error) {
 	length := len(origData)
+	if length == 0 {
+		return nil, errPadding
+	}
 	padding := int(origData[length-1])
-	return origData[:(length - padding)]
+	if padding == 0 || padding > length {
+		return nil, errPadding
+	}
+	for _, b := range origData[length-padding:] {
+		if int(b) != padding {
+			return nil, errPadding
+		}
+	}
+	return origData[:(length - padding)], nil
+}
+
+// Keyring 加密密钥环，当前密钥用于加密，其余的旧密钥只用于解密
+// Option.Secret 等价于标识符为 0 的密钥
+type Keyring struct {
+	Current uint32            `yaml:"Current"` // 当前用于加密的密钥标识符
+	Keys    map[uint32]string `yaml:"Keys"`    // 密钥标识符 -> 密钥
+}
+
+// keyring 编码器使用的密钥环，轮换密钥时会被并发修改
+type keyring struct {
+	mu      sync.RWMutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// newKeyring 创建密钥环
+func newKeyring(current uint32, keys map[uint32][]byte) *keyring {
+	return &keyring{current: current, keys: keys}
+}
+
+// currentKey 返回当前用于加密的密钥和它的标识符
+func (k *keyring) currentKey() (uint32, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+// key 返回指定标识符的密钥
+func (k *keyring) key(id uint32) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// rotate 加入新的密钥并将它作为当前密钥
+func (k *keyring) rotate(id uint32, key []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if old, ok := k.keys[id]; ok && !bytes.Equal(old, key) {
+		return fmt.Errorf("encryption key %d already exists with a different value", id)
+	}
+
+	k.keys[id] = key
+	k.current = id
+
+	return nil
+}
+
+// validKeySize 判断密钥长度是否可以用于 AES
+func validKeySize(key []byte) bool {
+	n := len(key)
+	return n == 16 || n == 24 || n == 32
+}
+
+// RotateKey 使用新的密钥同步地重新加密所有的数据，已经在进行的合并和值日志垃圾回收会先等待完成
+// 使用 KeyProvider 或者口令时由 RotateDataKey 轮换
+func (db *DB) RotateKey(id uint32, key string) error {
+	if db.keyProvider != nil {
+		return errors.New("the data key is managed by the key provider, use RotateDataKey instead")
+	}
+	return db.rotateKey(id, key)
+}
+
+// rotateKey 将新的密钥设为当前密钥，并使用它重新加密所有的数据
+func (db *DB) rotateKey(id uint32, key string) error {
+	if !db.encoder.enable {
+		return errors.New("encryption is not enabled")
+	}
+
+	if !validKeySize([]byte(key)) {
+		return fmt.Errorf("the encryption key %d must be 16, 24 or 32 bytes", id)
+	}
+
+	if err := db.encoder.keyring.rotate(id, []byte(key)); err != nil {
+		return err
+	}
+
+	// 值日志中的值和数据块不会被合并复制，需要全部重新写入，新的指针随后被合并
+	if err := db.retryBusy(func() error { return db.collectValueLogs(0, true) }); err != nil {
+		return err
+	}
+
+	// 等待正在进行的合并完成，然后合并所有的数据文件
+	return db.retryBusy(func() error {
+		err := db.merge(0)
+		// 压缩字典也使用新的密钥重新加密
+		if dicts := db.encoder.dicts.all(); err == nil && len(dicts) > 0 {
+			err = db.writeDictionaries(dicts)
+		}
+		return err
+	})
+}
+
+// busyRetryInterval 其他的后台任务正在进行时重试的间隔
+const busyRetryInterval = 10 * time.Millisecond
+
+// retryBusy 其他的合并、垃圾回收或者流式写入正在进行时，等待 busyRetryInterval 之后重新调用 fn
+func (db *DB) retryBusy(fn func() error) error {
+	for {
+		err := fn()
+		if err != errMerging && err != errCollecting && err != errStreaming {
+			return err
+		}
+
+		select {
+		case <-db.closing:
+			return errors.New("the storage engine is closed")
+		case <-time.After(busyRetryInterval):
+		}
+	}
 }
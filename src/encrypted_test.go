@@ -1,9 +1,78 @@
 package step
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
 
 func checkErr(t *testing.T, err error) {
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+func TestPKCS7UnPadding(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want []byte
+		ok   bool
+	}{
+		{[]byte{'a', 'b', 2, 2}, []byte("ab"), true},
+		{[]byte{4, 4, 4, 4}, []byte{}, true},
+		{nil, nil, false},
+		{[]byte{'a', 'b', 'c', 0}, nil, false},
+		{[]byte{'a', 'b', 'c', 5}, nil, false},
+		{[]byte{'a', 'b', 1, 2}, nil, false},
+	}
+
+	for _, test := range tests {
+		got, err := PKCS7UnPadding(test.data)
+		if (err == nil) != test.ok || !bytes.Equal(got, test.want) {
+			t.Errorf("PKCS7UnPadding(%v) = %v, %v", test.data, got, err)
+		}
+	}
+
+	// 不完整的分组不会导致 panic
+	if _, err := aesDecrypt([]byte("short"), []byte("1234567890123456")); err == nil {
+		t.Error("aesDecrypt() accepted a partial block")
+	}
+}
+
+func TestGCMEncryptor(t *testing.T) {
+	var (
+		encryptor GCMEncryptor
+		secret    = []byte("12345678901234567890123456789012")
+	)
+
+	encode := func() *SourceData {
+		sd := &SourceData{Data: []byte("value"), Secret: secret, AdditionalData: []byte("key")}
+		checkErr(t, encryptor.Encode(sd))
+		return sd
+	}
+
+	first, second := encode(), encode()
+	if bytes.Equal(first.Data, second.Data) {
+		t.Error("the same value was encrypted with the same nonce twice")
+	}
+
+	checkErr(t, encryptor.Decode(second))
+	if string(second.Data) != "value" {
+		t.Errorf("Decode() = %q, want %q", second.Data, "value")
+	}
+
+	tampered := encode()
+	tampered.Data[len(tampered.Data)-1] ^= 1
+
+	moved := encode()
+	moved.AdditionalData = []byte("other")
+
+	wrongKey := encode()
+	wrongKey.Secret = []byte("abcdefghijklmnopqrstuvwxyz123456")
+
+	for _, sd := range []*SourceData{tampered, moved, wrongKey, {Data: []byte("short"), Secret: secret}} {
+		if err := encryptor.Decode(sd); !errors.Is(err, ErrTampered) {
+			t.Errorf("Decode() error = %v, want %v", err, ErrTampered)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package step
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 数据文件和提示文件的格式版本
+// formatV1 最初版本的格式，没有文件头，时间戳精确到秒，索引是关闭时写入的整个内存索引的快照
+// formatV2 带有文件头，时间戳精确到纳秒，偏移值为 64 位
+const (
+	formatV1 uint16 = iota + 1
+	formatV2
+)
+
+// currentFormat 新写入的文件使用的格式版本
+const currentFormat = formatV2
+
+// fileHeaderSize 文件头的长度
+// | MAGIC 4 | VERSION 2 | FLAGS 2 |
+const fileHeaderSize = 8
+
+// 文件头中的功能标志，描述文件内容的编码方式
+const (
+	// fileEncrypted 文件中的数据经过加密
+	fileEncrypted uint16 = 1 << iota
+	// fileAESGCM 加密的数据使用 AES-GCM，没有设置时使用 AES-CBC
+	fileAESGCM
+	// fileKeyID 加密的数据以 4 字节的密钥标识符开头，没有设置时使用标识符为 0 的密钥
+	fileKeyID
+	// fileSealed 记录和提示文件整体加密，包括键和元数据
+	fileSealed
+)
+
+// knownFileFlags 当前版本能够识别的所有功能标志
+const knownFileFlags = fileEncrypted | fileAESGCM | fileKeyID | fileSealed
+
+var (
+	// dataMagic 数据文件的魔数
+	dataMagic = []byte("STPD")
+
+	// indexMagic 提示文件的魔数
+	indexMagic = []byte("STPI")
+)
+
+// legacyItemPadding formatV1 数据记录编码头的长度，记录中没有过期时间和标志位
+// | CRC 4 | TS 8 | KS 4 | VS 4 | KEY ? | VALUE ? |
+const legacyItemPadding = 20
+
+// legacyIndexSize formatV1 索引项的长度，索引项中只有键的哈希值
+// | CRC32 4 | IDX 8 | FID 8 | TS 4 | ET 4 | SZ 4 | OF 4 |
+const legacyIndexSize = 36
+
+// legacyNoExpire formatV1 中没有设置过期时间的记录保存的值，即零值 time.Time 的 Unix 秒数截断为 32 位
+var legacyNoExpire = uint32(time.Time{}.Unix())
+
+// dataFile 只读的数据文件和它的文件头
+type dataFile struct {
+	*os.File
+	version uint16
+	flags   uint16
+}
+
+// fileHeader 编码文件头
+func fileHeader(magic []byte, flags uint16) []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf[:4], magic)
+	binary.LittleEndian.PutUint16(buf[4:6], currentFormat)
+	binary.LittleEndian.PutUint16(buf[6:8], flags)
+	return buf
+}
+
+// readFileHeader 读取文件头中的格式版本和功能标志，没有文件头的文件属于 formatV1
+func readFileHeader(file *os.File, magic []byte) (version, flags uint16, err error) {
+	buf := make([]byte, fileHeaderSize)
+
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	if n < fileHeaderSize || !bytes.Equal(buf[:4], magic) {
+		return formatV1, 0, nil
+	}
+
+	return binary.LittleEndian.Uint16(buf[4:6]), binary.LittleEndian.Uint16(buf[6:8]), nil
+}
+
+// dataFlags 返回当前选项下写入数据文件的功能标志
+func (db *DB) dataFlags() uint16 {
+	var flags uint16
+	if db.encoder.enable {
+		flags |= fileEncrypted | fileKeyID
+	}
+	if db.encoder.enable && db.encoder.cipher == AESGCM {
+		flags |= fileAESGCM
+	}
+	if db.encoder.enable && db.encoder.full {
+		flags |= fileSealed
+	}
+	return flags
+}
+
+// checkFiles 检查所有数据文件和提示文件的文件头，格式或者选项不匹配时返回明确的错误
+func (db *DB) checkFiles() error {
+	ids, err := db.dataFileIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, fid := range ids {
+		if err := db.checkFile(db.dataSuffixFunc(fid), dataMagic); err != nil {
+			return err
+		}
+		if err := db.checkFile(db.indexSuffixFunc(fid), indexMagic); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := db.checkSealedFile(fid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSealedFile 解密整体加密的数据文件中的第一条记录
+// 密钥错误时所有记录都无法通过认证，需要在这里返回错误，避免恢复数据时把它们当作不完整的记录截断
+func (db *DB) checkSealedFile(fid int64) error {
+	file, err := db.openReadOnly(fid)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if file.flags&fileSealed == 0 {
+		return nil
+	}
+
+	_, _, err = db.encoder.readSealed(file, fileHeaderSize)
+	if err == ErrTampered {
+		return fmt.Errorf("%s cannot be decrypted with the configured keys: %w", file.Name(), err)
+	}
+	if err == io.EOF || err == errTornRecord {
+		return nil
+	}
+
+	return err
+}
+
+// checkFile 检查一个文件的文件头
+func (db *DB) checkFile(name string, magic []byte) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	version, flags, err := readFileHeader(file, magic)
+	if err != nil {
+		return err
+	}
+
+	if version == formatV1 {
+		return checkLegacyFile(file, info.Size(), magic)
+	}
+
+	// 带有文件头的格式从 formatV2 开始
+	if version < formatV2 || version > currentFormat {
+		return fmt.Errorf("%s uses unsupported format version %d", name, version)
+	}
+
+	if flags&^knownFileFlags != 0 {
+		return fmt.Errorf("%s uses unsupported feature flags %#x", name, flags&^knownFileFlags)
+	}
+
+	// 提示文件中只有索引项，不受加密选项的影响
+	if !bytes.Equal(magic, dataMagic) {
+		return nil
+	}
+
+	if flags&fileEncrypted != 0 && !db.encoder.enable {
+		return fmt.Errorf("%s is encrypted but encryption is not enabled", name)
+	}
+	if flags&fileEncrypted == 0 && db.encoder.enable {
+		return fmt.Errorf("%s is not encrypted but encryption is enabled", name)
+	}
+
+	return nil
+}
+
+// checkLegacyFile 检查没有文件头的文件，只有内容以一条完整的 formatV1 记录开始时才是旧格式的文件
+func checkLegacyFile(file *os.File, size int64, magic []byte) error {
+	// 空文件和不完整的文件头是写入文件头之前异常退出留下的
+	if size < fileHeaderSize {
+		header := make([]byte, size)
+		if _, err := file.ReadAt(header, 0); err != nil {
+			return err
+		}
+		if bytes.HasPrefix(magic, header) {
+			return nil
+		}
+	}
+
+	var err error
+	if bytes.Equal(magic, dataMagic) {
+		_, _, err = readItemAt(&dataFile{File: file, version: formatV1}, 0)
+	} else {
+		_, err = readLegacyIndex(io.NewSectionReader(file, 0, size))
+		// 索引快照由完整的索引项组成
+		if err == nil && size%legacyIndexSize != 0 {
+			err = errors.New("index record is incomplete")
+		}
+	}
+
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s is not a valid step file", file.Name())
+	}
+
+	return nil
+}
+
+// dataOffset 返回指定格式的数据文件中第一条记录的偏移值
+func dataOffset(version uint16) int64 {
+	if version == formatV1 {
+		return 0
+	}
+	return fileHeaderSize
+}
+
+// legacyExpireTime 将 formatV1 中以秒为单位的过期时间转换为纳秒
+func legacyExpireTime(expire uint32) uint64 {
+	if expire == legacyNoExpire {
+		return 0
+	}
+	return uint64(expire) * uint64(time.Second)
+}
+
+// legacyDecode 将 formatV1 的二进制数据解析为 item，过期时间只保存在索引快照中
+func legacyDecode(data []byte) *Item {
+	// 检查数据是否完整
+	if len(data) < legacyItemPadding || binary.LittleEndian.Uint32(data[:4]) != crc32.ChecksumIEEE(data[4:]) {
+		return nil
+	}
+
+	var item Item
+	// | CRC 4 | TS 8 | KS 4 | VS 4 | KEY ? | VALUE ? |
+	item.CRC32 = binary.LittleEndian.Uint32(data[:4])
+	item.TimeStamp = binary.LittleEndian.Uint64(data[4:12]) * uint64(time.Second)
+	item.KeySize = binary.LittleEndian.Uint32(data[12:16])
+	item.ValueSize = binary.LittleEndian.Uint32(data[16:20])
+
+	if len(data) != legacyItemPadding+int(item.KeySize)+int(item.ValueSize) {
+		return nil
+	}
+
+	item.Key = append([]byte{}, data[legacyItemPadding:legacyItemPadding+item.KeySize]...)
+	item.Value = append([]byte{}, data[legacyItemPadding+item.KeySize:]...)
+	return &item
+}
+
+// legacyIndexEntry formatV1 索引快照中的一项
+type legacyIndexEntry struct {
+	hash      uint64
+	fid       int64
+	timestamp uint64
+	expire    uint64
+	size      uint32
+	offset    int64
+}
+
+// readLegacyIndex 读取 formatV1 的索引项，读取到文件末尾时返回 io.EOF
+func readLegacyIndex(r io.Reader) (*legacyIndexEntry, error) {
+	buf := make([]byte, legacyIndexSize)
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errors.New("index record is incomplete")
+	}
+
+	if binary.LittleEndian.Uint32(buf[:4]) != crc32.ChecksumIEEE(buf[4:]) {
+		return nil, errors.New("index record verification failed")
+	}
+
+	return &legacyIndexEntry{
+		hash:      binary.LittleEndian.Uint64(buf[4:12]),
+		fid:       int64(binary.LittleEndian.Uint64(buf[12:20])),
+		timestamp: uint64(binary.LittleEndian.Uint32(buf[20:24])) * uint64(time.Second),
+		expire:    legacyExpireTime(binary.LittleEndian.Uint32(buf[24:28])),
+		size:      binary.LittleEndian.Uint32(buf[28:32]),
+		offset:    int64(binary.LittleEndian.Uint32(buf[32:36])),
+	}, nil
+}
+
+// legacySnapshot formatV1 的索引快照
+// 旧版本只在关闭时把整个内存索引写入以 Unix 秒数命名的索引文件，删除和过期时间也只体现在快照中
+type legacySnapshot struct {
+	// 写入快照的时间，纳秒
+	time uint64
+
+	// 快照中的索引项 [hash(key) -> entry]
+	entries map[uint64]*legacyIndexEntry
+}
+
+// loadLegacySnapshot 读取索引文件夹中最新的 formatV1 索引快照，没有快照时返回 nil
+func (db *DB) loadLegacySnapshot() (*legacySnapshot, error) {
+	files, err := ioutil.ReadDir(db.indexDirectory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var latest int64 = -1
+
+	// 提示文件都带有文件头，没有文件头的索引文件是旧版本的快照
+	for _, info := range files {
+		if path.Ext(info.Name()) != indexFileSuffix || info.Size() < legacyIndexSize {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), indexFileSuffix), 10, 64)
+		if err != nil || id <= latest {
+			continue
+		}
+		file, err := os.Open(db.indexDirectory + info.Name())
+		if err != nil {
+			return nil, err
+		}
+		version, _, err := readFileHeader(file, indexMagic)
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if version == formatV1 {
+			latest = id
+		}
+	}
+
+	if latest < 0 {
+		return nil, nil
+	}
+
+	file, err := os.Open(db.indexSuffixFunc(latest))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		snapshot = &legacySnapshot{time: uint64(latest) * uint64(time.Second), entries: make(map[uint64]*legacyIndexEntry)}
+		reader   = bufio.NewReader(file)
+	)
+
+	for {
+		entry, err := readLegacyIndex(reader)
+		if err == io.EOF {
+			return snapshot, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+		snapshot.entries[entry.hash] = entry
+	}
+}
+
+// keep 判断 formatV1 数据文件中的记录是否仍然有效，有效时从快照中补齐过期时间
+// 快照之后写入的记录不在快照中，同一秒内写入的记录也无法区分先后，都视为有效
+func (s *legacySnapshot) keep(hash uint64, rec *record) bool {
+	if s == nil {
+		return true
+	}
+	if entry, ok := s.entries[hash]; ok && entry.fid == rec.FID && entry.offset == rec.Offset {
+		rec.ExpireTime = entry.expire
+		return true
+	}
+	return rec.Timestamp >= s.time
+}
@@ -0,0 +1,113 @@
+package step
+
+import "bytes"
+
+// IndexType 内存索引的类型
+type IndexType uint8
+
+const (
+	// HashIndex 哈希索引，只支持单个键的查询
+	HashIndex IndexType = iota
+	// OrderedIndex 基于跳表的有序索引，支持范围查询和前缀查询
+	OrderedIndex
+)
+
+// indexer 内存索引需要实现的接口
+type indexer interface {
+	// get 查找指定键的 record，不存在时返回 nil
+	get(key []byte) *record
+	// put 添加或者替换 record.Key 对应的 record
+	put(rec *record)
+	// remove 删除指定键的 record
+	remove(key []byte)
+	// len 返回索引中键的数量
+	len() int
+	// iterate 遍历索引中所有的 record，fn 返回 false 时停止遍历
+	iterate(fn func(rec *record) bool)
+}
+
+// orderedIndexer 按照键的顺序保存 record 的内存索引
+type orderedIndexer interface {
+	indexer
+	// ascend 按照键的升序遍历 [start, end) 范围内的 record，nil 表示不限制边界
+	ascend(start, end []byte, fn func(rec *record) bool)
+}
+
+// hashIndex 内存索引 [uint64 -> []record]
+// 以键的哈希值分桶，桶内保存完整的键，哈希冲突的键可以共存
+type hashIndex struct {
+	hashed  Hashed
+	buckets map[uint64][]*record
+	size    int
+}
+
+// newHashIndex 使用指定的 hash 函数创建内存索引
+func newHashIndex(hashed Hashed) *hashIndex {
+	return &hashIndex{
+		hashed:  hashed,
+		buckets: make(map[uint64][]*record),
+	}
+}
+
+// get 查找指定键的 record，不存在时返回 nil
+func (h *hashIndex) get(key []byte) *record {
+	for _, rec := range h.buckets[h.hashed.Sum64(key)] {
+		if bytes.Equal(rec.Key, key) {
+			return rec
+		}
+	}
+	return nil
+}
+
+// put 添加或者替换 record.Key 对应的 record
+func (h *hashIndex) put(rec *record) {
+	sum64 := h.hashed.Sum64(rec.Key)
+	bucket := h.buckets[sum64]
+
+	for i, old := range bucket {
+		if bytes.Equal(old.Key, rec.Key) {
+			bucket[i] = rec
+			return
+		}
+	}
+
+	h.buckets[sum64] = append(bucket, rec)
+	h.size++
+}
+
+// remove 删除指定键的 record
+func (h *hashIndex) remove(key []byte) {
+	sum64 := h.hashed.Sum64(key)
+	bucket := h.buckets[sum64]
+
+	for i, rec := range bucket {
+		if bytes.Equal(rec.Key, key) {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			h.size--
+			break
+		}
+	}
+
+	if len(bucket) == 0 {
+		delete(h.buckets, sum64)
+		return
+	}
+
+	h.buckets[sum64] = bucket
+}
+
+// len 返回索引中键的数量
+func (h *hashIndex) len() int {
+	return h.size
+}
+
+// iterate 遍历索引中所有的 record，fn 返回 false 时停止遍历
+func (h *hashIndex) iterate(fn func(rec *record) bool) {
+	for _, bucket := range h.buckets {
+		for _, rec := range bucket {
+			if !fn(rec) {
+				return
+			}
+		}
+	}
+}
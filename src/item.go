@@ -1,9 +1,8 @@
 package step
 
 import (
+	"errors"
 	"strconv"
-
-	"gopkg.in/mgo.v2/bson"
 )
 
 // Log the key value data
@@ -12,14 +11,16 @@ type Log struct {
 }
 
 // Item each data operation log item
-// | TS 8 | CRC 4 | KS 4 | VS 4  | KEY ? | VALUE ? |
-// ItemPadding = 8 + 12 = 20 byte 20 * 8 = 160 bit
+// | CRC 4 | TS 8 | ET 8 | KS 4 | VS 4 | FG 1 | KEY ? | VALUE ? |
+// ItemPadding = 4 + 16 + 8 + 1 = 29 byte 29 * 8 = 232 bit
 type Item struct {
-	TimeStamp uint64 // Create timestamp
-	CRC32     uint32 // Cyclic check code
-	KeySize   uint32 // The size of the key
-	ValueSize uint32 // The size of the value
-	Log              // Key string, value serialization
+	TimeStamp  uint64 // Create timestamp in nanoseconds
+	ExpireTime uint64 // Expire timestamp in nanoseconds, 0 never expires
+	CRC32      uint32 // Cyclic check code
+	KeySize    uint32 // The size of the key
+	ValueSize  uint32 // The size of the value
+	Flag       uint8  // Record type flags
+	Log               // Key string, value serialization
 }
 
 // NewItem build a data log item
@@ -37,6 +38,9 @@ func NewItem(key, value []byte, timestamp uint64) *Item {
 type Data struct {
 	Err error
 	*Item
+
+	// 读取数据的 DB 使用的 Codec
+	codec Codec
 }
 
 // IsError return an error
@@ -45,10 +49,15 @@ func (d Data) IsError() bool {
 }
 
 // Unwrap specifies a type pointer to parse data
-func (d *Data) Unwrap(v interface{}) {
-	if d.Item != nil {
-		_ = bson.Unmarshal(d.Value, v)
+// 默认使用读取数据的 DB 的 Codec，codec 可以为本次调用指定其他的 Codec
+func (d *Data) Unwrap(v interface{}, codec ...Codec) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	if d.Item == nil {
+		return errors.New("there is no data to unwrap")
 	}
+	return selectCodec(d.codec, codec).Unmarshal(d.Value, v)
 }
 
 // String convert data to a string
@@ -94,13 +103,3 @@ func (d Data) Bool() bool {
 	}
 	return false
 }
-
-// Bson 将数据转换为Bson二进制
-func Bson(v interface{}) []byte {
-	if v == nil {
-		// ??? NIL
-		return []byte{}
-	}
-	bytes, _ := bson.Marshal(v)
-	return bytes
-}
@@ -0,0 +1,127 @@
+package step
+
+import (
+	"errors"
+	"time"
+)
+
+// errUnorderedIndex 当前的内存索引不支持范围查询
+var errUnorderedIndex = errors.New("the current index does not support range queries, open with OrderedIndex")
+
+// Range 范围查询的附加选项
+type Range struct {
+	Reverse bool // 按照键的降序遍历
+}
+
+// Iterator 遍历范围查询的结果
+// 查询时保存了满足条件的键，遍历时读取每个键当前的值，查询之后被删除或者过期的键会被跳过，新写入的键不会出现
+type Iterator struct {
+	db   *DB
+	keys [][]byte
+	pos  int
+	item *Item
+	err  error
+}
+
+// Next 移动到下一条记录，没有更多记录或者发生错误时返回 false
+func (it *Iterator) Next() bool {
+	it.db.mutex.RLock()
+	defer it.db.mutex.RUnlock()
+
+	for it.err == nil && it.pos < len(it.keys) {
+		key := it.keys[it.pos]
+		it.pos++
+
+		// 查询之后键可能被覆盖、删除或者合并到新的数据文件中，总是使用索引中当前的 record
+		rec := it.db.index.get(key)
+		if rec == nil || rec.expired(uint64(time.Now().UnixNano())) {
+			continue
+		}
+
+		it.item, it.err = it.db.read(rec)
+		return it.err == nil
+	}
+
+	it.item = nil
+	return false
+}
+
+// Key 返回当前记录的键
+func (it *Iterator) Key() []byte {
+	if it.item == nil {
+		return nil
+	}
+	return it.item.Key
+}
+
+// Value 返回当前记录的值
+func (it *Iterator) Value() []byte {
+	if it.item == nil {
+		return nil
+	}
+	return it.item.Value
+}
+
+// Data 将当前记录包装为 Data 返回
+func (it *Iterator) Data() *Data {
+	return &Data{Item: it.item, Err: it.err, codec: it.db.codec}
+}
+
+// Err 返回遍历过程中发生的错误
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Scan 返回键在 [start, end) 范围内并且没有过期的记录，nil 表示不限制边界
+func (db *DB) Scan(start, end []byte, rangeFunc ...func(r *Range)) (*Iterator, error) {
+	var opt Range
+
+	for _, fn := range rangeFunc {
+		fn(&opt)
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	ordered, ok := db.index.(orderedIndexer)
+	if !ok {
+		return nil, errUnorderedIndex
+	}
+
+	var (
+		keys [][]byte
+		now  = uint64(time.Now().UnixNano())
+	)
+
+	ordered.ascend(start, end, func(rec *record) bool {
+		if !rec.expired(now) {
+			keys = append(keys, rec.Key)
+		}
+		return true
+	})
+
+	if opt.Reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	return &Iterator{db: db, keys: keys}, nil
+}
+
+// PrefixScan 返回键以 prefix 开头并且没有过期的记录
+func (db *DB) PrefixScan(prefix []byte, rangeFunc ...func(r *Range)) (*Iterator, error) {
+	return db.Scan(prefix, prefixEnd(prefix), rangeFunc...)
+}
+
+// prefixEnd 返回大于所有以 prefix 开头的键的最小键，不存在时返回 nil
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package step
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrWrongPassphrase 口令无法解密数据目录中的数据密钥
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// defaultKDFIterations 新数据目录派生主密钥时 PBKDF2 的迭代次数
+var defaultKDFIterations uint32 = 600000
+
+// kdfSaltSize 派生主密钥使用的盐值长度
+const kdfSaltSize = 16
+
+// kdfParamsSize 数据密钥文件中派生参数的长度
+// | CRC 4 | ITER 4 | SALT 16 |
+const kdfParamsSize = 8 + kdfSaltSize
+
+// kdfParams 从口令派生主密钥的参数，保存在数据目录中
+type kdfParams struct {
+	iterations uint32
+	salt       []byte
+}
+
+// newKDFParams 生成随机盐值
+func newKDFParams() (*kdfParams, error) {
+	salt := make([]byte, kdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return &kdfParams{iterations: defaultKDFIterations, salt: salt}, nil
+}
+
+// deriveKey 从口令派生 32 字节的主密钥
+func (p *kdfParams) deriveKey(passphrase string) []byte {
+	return pbkdf2([]byte(passphrase), p.salt, int(p.iterations), dataKeySize)
+}
+
+// encode 编码派生参数
+func (p *kdfParams) encode() []byte {
+	buf := make([]byte, kdfParamsSize)
+	binary.LittleEndian.PutUint32(buf[4:8], p.iterations)
+	copy(buf[8:], p.salt)
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// readKDFParams 读取派生参数
+func readKDFParams(r io.Reader) (*kdfParams, error) {
+	buf := make([]byte, kdfParamsSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.New("key derivation parameters are incomplete")
+	}
+	if binary.LittleEndian.Uint32(buf[:4]) != crc32.ChecksumIEEE(buf[4:]) {
+		return nil, errors.New("key derivation parameters are corrupted")
+	}
+	return &kdfParams{iterations: binary.LittleEndian.Uint32(buf[4:8]), salt: buf[8:]}, nil
+}
+
+// pbkdf2 使用 HMAC-SHA256 的 PBKDF2，参考 RFC 8018
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	var (
+		prf   = hmac.New(sha256.New, password)
+		size  = prf.Size()
+		dk    = make([]byte, 0, (keyLen+size-1)/size*size)
+		block = make([]byte, 4)
+		u     []byte
+	)
+
+	for i := uint32(1); len(dk) < keyLen; i++ {
+		// U1 = PRF(P, S || INT(i))
+		binary.BigEndian.PutUint32(block, i)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(block)
+		u = prf.Sum(u[:0])
+
+		t := append([]byte{}, u...)
+		// Uc = PRF(P, Uc-1)，T = U1 ^ U2 ^ ... ^ Uc
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		dk = append(dk, t...)
+	}
+
+	return dk[:keyLen]
+}
+
+// derivePassphraseKey 读取或者生成派生参数，使用口令派生的主密钥解密数据密钥
+func (db *DB) derivePassphraseKey(passphrase string) error {
+	file, err := db.readKeysFile()
+	if err != nil {
+		return err
+	}
+
+	db.kdf = file.kdf
+	if db.kdf == nil {
+		// 数据密钥由其他方式的主密钥加密
+		if len(file.keys) > 0 {
+			return errors.New("the data keys are not protected by a passphrase")
+		}
+		if db.kdf, err = newKDFParams(); err != nil {
+			return err
+		}
+	}
+
+	db.keyProvider = masterKeyProvider(db.kdf.deriveKey(passphrase))
+
+	return nil
+}
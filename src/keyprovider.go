@@ -0,0 +1,352 @@
+package step
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyProvider 管理主密钥，为数据加密生成和解封数据密钥
+// 数据目录中只保存被主密钥加密的数据密钥，主密钥由 KeyProvider 在数据目录之外管理
+type KeyProvider interface {
+	// GetDataKey 生成一个新的数据密钥，返回明文的数据密钥和被主密钥加密后的数据密钥
+	GetDataKey() (plaintext, wrapped []byte, err error)
+	// UnwrapDataKey 使用主密钥解密被加密的数据密钥
+	UnwrapDataKey(wrapped []byte) ([]byte, error)
+}
+
+// dataKeySize 数据密钥的长度，使用 AES-256
+const dataKeySize = 32
+
+// keysFileName 数据目录中保存被加密的数据密钥的文件
+const keysFileName = "keys"
+
+// keysMagic 数据密钥文件的魔数
+var keysMagic = []byte("STPK")
+
+// dataKeyAAD 加密数据密钥时的附加认证数据
+var dataKeyAAD = []byte("step data key")
+
+// masterKeyProvider 使用内存中的主密钥，用于从口令派生的主密钥
+type masterKeyProvider []byte
+
+// GetDataKey 生成一个新的数据密钥
+func (p masterKeyProvider) GetDataKey() ([]byte, []byte, error) {
+	return newDataKey(p)
+}
+
+// UnwrapDataKey 使用主密钥解密数据密钥
+func (p masterKeyProvider) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	return unwrapDataKey(p, wrapped)
+}
+
+// FileKeyProvider 从文件中读取主密钥，文件内容为 16、24 或者 32 字节的密钥或者它的十六进制编码
+// 主密钥文件不能放在数据目录中
+type FileKeyProvider struct {
+	Path string
+}
+
+// GetDataKey 生成一个新的数据密钥
+func (p FileKeyProvider) GetDataKey() ([]byte, []byte, error) {
+	master, err := p.masterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newDataKey(master)
+}
+
+// UnwrapDataKey 使用主密钥解密数据密钥
+func (p FileKeyProvider) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	master, err := p.masterKey()
+	if err != nil {
+		return nil, err
+	}
+	return unwrapDataKey(master, wrapped)
+}
+
+// masterKey 读取主密钥
+func (p FileKeyProvider) masterKey() ([]byte, error) {
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMasterKey(data)
+}
+
+// EnvKeyProvider 从环境变量中读取主密钥，变量的值为 16、24 或者 32 字节的密钥或者它的十六进制编码
+type EnvKeyProvider struct {
+	Name string
+}
+
+// GetDataKey 生成一个新的数据密钥
+func (p EnvKeyProvider) GetDataKey() ([]byte, []byte, error) {
+	master, err := p.masterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newDataKey(master)
+}
+
+// UnwrapDataKey 使用主密钥解密数据密钥
+func (p EnvKeyProvider) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	master, err := p.masterKey()
+	if err != nil {
+		return nil, err
+	}
+	return unwrapDataKey(master, wrapped)
+}
+
+// masterKey 读取主密钥
+func (p EnvKeyProvider) masterKey() ([]byte, error) {
+	value, ok := os.LookupEnv(p.Name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", p.Name)
+	}
+	return parseMasterKey([]byte(value))
+}
+
+// parseMasterKey 解析主密钥，优先按照十六进制编码解析
+func parseMasterKey(data []byte) ([]byte, error) {
+	data = []byte(strings.TrimSpace(string(data)))
+
+	if key, err := hex.DecodeString(string(data)); err == nil && validKeySize(key) {
+		return key, nil
+	}
+	if validKeySize(data) {
+		return data, nil
+	}
+
+	return nil, errors.New("the master key must be 16, 24 or 32 bytes")
+}
+
+// newDataKey 生成随机的数据密钥并使用主密钥加密
+func newDataKey(master []byte) ([]byte, []byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+
+	sd := &SourceData{Data: key, Secret: master, AdditionalData: dataKeyAAD}
+	if err := (GCMEncryptor{}).Encode(sd); err != nil {
+		return nil, nil, err
+	}
+
+	return key, sd.Data, nil
+}
+
+// unwrapDataKey 使用主密钥解密数据密钥，主密钥错误时返回 ErrTampered
+func unwrapDataKey(master, wrapped []byte) ([]byte, error) {
+	sd := &SourceData{Data: wrapped, Secret: master, AdditionalData: dataKeyAAD}
+	if err := (GCMEncryptor{}).Decode(sd); err != nil {
+		return nil, err
+	}
+	return sd.Data, nil
+}
+
+// wrappedKey 被主密钥加密的数据密钥
+type wrappedKey struct {
+	id  uint32
+	key []byte
+}
+
+// keysFile 数据目录中保存的数据密钥和派生主密钥的参数
+type keysFile struct {
+	kdf  *kdfParams
+	keys []wrappedKey
+}
+
+// initDataKeys 使用口令派生的主密钥或者 KeyProvider 解密数据密钥
+func (db *DB) initDataKeys(opt Option) error {
+	if opt.Enable && opt.Passphrase != "" {
+		if err := db.derivePassphraseKey(opt.Passphrase); err != nil {
+			return err
+		}
+	}
+	if db.keyProvider == nil {
+		return nil
+	}
+	return db.loadDataKeys()
+}
+
+// loadDataKeys 读取数据目录中的数据密钥并使用 KeyProvider 解密，没有数据密钥时生成一个
+func (db *DB) loadDataKeys() error {
+	file, err := db.readKeysFile()
+	if err != nil {
+		return err
+	}
+
+	if len(file.keys) == 0 {
+		// 已有的数据文件无法使用新生成的数据密钥解密
+		if ids, err := db.dataFileIDs(); err != nil {
+			return err
+		} else if len(ids) > 0 {
+			return fmt.Errorf("%s%s is missing", db.root, keysFileName)
+		}
+
+		plaintext, key, err := db.keyProvider.GetDataKey()
+		if err != nil {
+			return err
+		}
+		file.kdf = db.kdf
+		file.keys = []wrappedKey{{id: 0, key: key}}
+		if err := db.writeKeysFile(file); err != nil {
+			return err
+		}
+		db.encoder.keyring = newKeyring(0, map[uint32][]byte{0: plaintext})
+		return nil
+	}
+
+	var (
+		current uint32
+		keys    = make(map[uint32][]byte, len(file.keys))
+	)
+
+	for _, w := range file.keys {
+		key, err := db.keyProvider.UnwrapDataKey(w.key)
+		if err == ErrTampered && db.kdf != nil {
+			return ErrWrongPassphrase
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unwrap data key %d: %w", w.id, err)
+		}
+		keys[w.id] = key
+		// 最后加入的数据密钥是当前密钥
+		current = w.id
+	}
+
+	db.encoder.keyring = newKeyring(current, keys)
+
+	return nil
+}
+
+// RotateDataKey 通过 KeyProvider 生成新的数据密钥，保存到数据目录之后使用它重新加密所有的数据
+func (db *DB) RotateDataKey() error {
+	if db.keyProvider == nil {
+		return errors.New("no key provider is configured")
+	}
+
+	plaintext, key, err := db.keyProvider.GetDataKey()
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	var id uint32
+	file, err := db.readKeysFile()
+	if err == nil {
+		if n := len(file.keys); n > 0 {
+			id = file.keys[n-1].id + 1
+		}
+		file.keys = append(file.keys, wrappedKey{id: id, key: key})
+		// 数据密钥落盘之后才能用于加密
+		err = db.writeKeysFile(file)
+	}
+	db.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return db.rotateKey(id, string(plaintext))
+}
+
+// keysKDF 数据密钥文件的功能标志，文件头之后保存派生主密钥的参数
+const keysKDF uint16 = 1
+
+// readKeysFile 读取数据目录中的数据密钥，文件不存在时返回空的 keysFile
+// | MAGIC 4 | VERSION 2 | FLAGS 2 | KDF PARAMS ? | 之后每一项为 | CRC 4 | ID 4 | LEN 4 | WRAPPED KEY ? |
+func (db *DB) readKeysFile() (*keysFile, error) {
+	keys := new(keysFile)
+
+	file, err := os.Open(db.root + keysFileName)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	version, flags, err := readFileHeader(file, keysMagic)
+	if err != nil {
+		return nil, err
+	}
+	if version != currentFormat || flags&^keysKDF != 0 {
+		return nil, fmt.Errorf("%s is not a valid keys file", file.Name())
+	}
+
+	var (
+		reader = bufio.NewReader(io.NewSectionReader(file, fileHeaderSize, 1<<62))
+		header = make([]byte, 12)
+	)
+
+	if flags&keysKDF != 0 {
+		if keys.kdf, err = readKDFParams(reader); err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+	}
+
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s is incomplete", file.Name())
+		}
+
+		key := make([]byte, binary.LittleEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return nil, fmt.Errorf("%s is incomplete", file.Name())
+		}
+
+		if crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, key) != binary.LittleEndian.Uint32(header[:4]) {
+			return nil, fmt.Errorf("%s is corrupted", file.Name())
+		}
+
+		keys.keys = append(keys.keys, wrappedKey{id: binary.LittleEndian.Uint32(header[4:8]), key: key})
+	}
+}
+
+// writeKeysFile 写入所有的数据密钥，先写入临时文件再重命名
+func (db *DB) writeKeysFile(keys *keysFile) error {
+	var buf []byte
+
+	if keys.kdf != nil {
+		buf = append(fileHeader(keysMagic, keysKDF), keys.kdf.encode()...)
+	} else {
+		buf = fileHeader(keysMagic, 0)
+	}
+
+	for _, key := range keys.keys {
+		entry := make([]byte, 12+len(key.key))
+		binary.LittleEndian.PutUint32(entry[4:8], key.id)
+		binary.LittleEndian.PutUint32(entry[8:12], uint32(len(key.key)))
+		copy(entry[12:], key.key)
+		binary.LittleEndian.PutUint32(entry[:4], crc32.ChecksumIEEE(entry[4:]))
+		buf = append(buf, entry...)
+	}
+
+	return writeFileAtomic(db.root+keysFileName, buf)
+}
+
+// insideDirectory 判断 name 是否位于文件夹 dir 中
+func insideDirectory(name, dir string) bool {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
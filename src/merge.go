@@ -0,0 +1,540 @@
+package step
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultMergeInterval 默认检查是否需要合并数据的时间间隔
+var defaultMergeInterval = time.Minute
+
+// errMerging 已经有合并正在进行
+var errMerging = errors.New("a merge is already in progress")
+
+// mergePlan 一次合并涉及的数据文件和 record
+type mergePlan struct {
+	// 参与合并的数据文件
+	sealed []int64
+
+	// 参与合并的数据文件中有效的 record
+	records []*record
+
+	// 没有参与合并的数据文件中最小的标识符，这些文件中的旧数据需要删除标记来覆盖
+	oldest int64
+
+	// 参与合并的数据文件中已经过期的 record，更早的数据文件没有参与合并时需要删除标记
+	expired []*record
+
+	// 合并后的数据文件使用 [first, last] 范围内的标识符
+	first, last int64
+
+	// 旧 record 到合并后 record 的映射
+	mapping map[*record]*record
+
+	// 合并后数据文件的空间使用情况
+	stats []FileStat
+}
+
+// Merge 合并数据文件，清除被覆盖、删除和过期的数据
+// 设置了 MergeRatio 时只合并无效数据超过该比例的数据文件，没有符合条件的文件时直接返回
+// 合并期间可以正常读写，新的数据文件和提示文件落盘之后才会删除旧的数据文件
+func (db *DB) Merge() error {
+	return db.merge(db.mergeRatio)
+}
+
+// merge 合并无效数据超过 ratio 的数据文件，ratio 为 0 时合并所有的数据文件
+func (db *DB) merge(ratio float64) error {
+	plan, err := db.prepareMerge(ratio)
+	if err != nil || plan == nil {
+		return err
+	}
+
+	if err := db.writeMergeFiles(plan); err != nil {
+		db.mutex.Lock()
+		db.merging = false
+		db.mutex.Unlock()
+		_ = os.RemoveAll(db.mergeDirectory)
+		return err
+	}
+
+	if err := db.finishMerge(plan); err != nil {
+		db.mutex.Lock()
+		db.merging = false
+		db.mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// prepareMerge 选出参与合并的数据文件，将可写文件切换为只读并收集有效的 record
+// 合并后的数据文件使用的标识符位于旧数据文件和新的可写文件之间
+func (db *DB) prepareMerge(ratio float64) (*mergePlan, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.merging {
+		return nil, errMerging
+	}
+
+	db.sweepExpired()
+
+	var (
+		plan     = &mergePlan{oldest: math.MaxInt64}
+		selected = make(map[int64]bool)
+		garbage  bool
+	)
+
+	// 空文件总是参与合并，但是只有空文件时不需要合并
+	for fid, stat := range db.stats {
+		if stat.TotalSize == 0 || stat.GarbageRatio() >= ratio {
+			selected[fid] = true
+			garbage = garbage || stat.TotalSize > 0 || ratio == 0
+		}
+	}
+
+	if !garbage {
+		return nil, nil
+	}
+
+	// 合并后的数据文件必须位于可写文件之后，所以可写文件总是切换为只读
+	if err := db.closeActiveFile(); err != nil {
+		return nil, err
+	}
+
+	for fid := range db.stats {
+		if selected[fid] {
+			plan.sealed = append(plan.sealed, fid)
+		} else if fid < plan.oldest {
+			plan.oldest = fid
+		}
+	}
+
+	for _, rec := range db.expired {
+		if selected[rec.FID] && rec.FID > plan.oldest {
+			plan.expired = append(plan.expired, rec)
+		}
+	}
+
+	var total int64
+
+	db.index.iterate(func(rec *record) bool {
+		if selected[rec.FID] {
+			plan.records = append(plan.records, rec)
+			total += int64(rec.Size)
+		}
+		return true
+	})
+
+	// 预留合并后数据文件的标识符
+	count := total / db.maxFileSize
+	if total%db.maxFileSize != 0 || count == 0 {
+		count++
+	}
+
+	plan.first = db.dataFileVersion + 1
+	plan.last = db.dataFileVersion + count
+	db.dataFileVersion = plan.last
+
+	if err := db.createActiveFile(); err != nil {
+		return nil, err
+	}
+
+	db.merging = true
+
+	return plan, nil
+}
+
+// mergeTombstones 返回参与合并的数据文件中仍然需要保留的删除标记，过期的 record 同样需要删除标记
+// 只有更早的数据文件没有参与合并，并且键没有被重新写入时才需要保留
+func (db *DB) mergeTombstones(plan *mergePlan) ([]indexItem, error) {
+	latest := make(map[string]indexItem)
+
+	for _, fid := range plan.sealed {
+		if fid < plan.oldest {
+			continue
+		}
+
+		items, err := db.readHintFile(fid)
+		if err != nil {
+			if items, _, err = db.scanDataFile(fid); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, item := range items {
+			if item.flag&flagTombstone == 0 {
+				continue
+			}
+			if old, ok := latest[string(item.Key)]; !ok || old.FID <= item.FID {
+				latest[string(item.Key)] = item
+			}
+		}
+	}
+
+	for _, rec := range plan.expired {
+		if old, ok := latest[string(rec.Key)]; !ok || old.FID <= rec.FID {
+			latest[string(rec.Key)] = indexItem{flag: flagTombstone, record: rec}
+		}
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var tombstones []indexItem
+
+	for _, item := range latest {
+		if db.index.get(item.Key) == nil {
+			tombstones = append(tombstones, item)
+		}
+	}
+
+	return tombstones, nil
+}
+
+// writeMergeFiles 将有效的数据和需要保留的删除标记写入合并文件夹
+func (db *DB) writeMergeFiles(plan *mergePlan) error {
+	if err := os.MkdirAll(db.mergeDirectory, Perm); err != nil {
+		return err
+	}
+
+	tombstones, err := db.mergeTombstones(plan)
+	if err != nil {
+		return err
+	}
+
+	// 合并写入的记录使用新训练的字典压缩
+	if err := db.trainMergeDictionary(plan); err != nil {
+		return err
+	}
+
+	var (
+		fid          = plan.first
+		offset int64 = fileHeaderSize
+		hints  []indexItem
+		stat   = FileStat{FID: fid}
+	)
+
+	plan.mapping = make(map[*record]*record, len(plan.records))
+
+	file, err := db.openMergeFile(fid)
+	if err != nil {
+		return err
+	}
+
+	// 写入的数据文件和提示文件落盘后关闭
+	finish := func() error {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		plan.stats = append(plan.stats, stat)
+		return db.writeIndexFile(db.mergeSuffixFunc(fid, indexFileSuffix), hints)
+	}
+
+	// 按照文件最大尺寸切换文件，预留的标识符用完之后写入最后一个文件
+	rotate := func() error {
+		if int64(offset) < db.maxFileSize || fid >= plan.last {
+			return nil
+		}
+		if err := finish(); err != nil {
+			return err
+		}
+
+		fid++
+		offset = fileHeaderSize
+		hints = nil
+		stat = FileStat{FID: fid}
+
+		file, err = db.openMergeFile(fid)
+		return err
+	}
+
+	// 删除标记写在最前面，不会覆盖同一个文件中之后写入的数据
+	for _, tombstone := range tombstones {
+		if err := rotate(); err != nil {
+			return err
+		}
+
+		item := NewItem(tombstone.Key, nil, uint64(tombstone.Timestamp))
+		item.Flag = flagTombstone
+
+		size, err := db.encoder.Write(item, file)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+
+		hints = append(hints, indexItem{
+			flag: flagTombstone,
+			record: &record{
+				Key:       tombstone.Key,
+				FID:       fid,
+				Size:      uint32(size),
+				Offset:    offset,
+				Timestamp: tombstone.Timestamp,
+			},
+		})
+
+		offset += int64(size)
+		stat.TotalSize += int64(size)
+		stat.DeadSize += int64(size)
+	}
+
+	for _, rec := range plan.records {
+		if err := rotate(); err != nil {
+			return err
+		}
+
+		db.mutex.RLock()
+		item, err := db.encoder.Read(rec, db.fileList)
+		db.mutex.RUnlock()
+
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+
+		// 合并后的数据已经提交，不再属于任何批量写入
+		item.Flag &^= flagBatch
+
+		size, err := db.encoder.Write(item, file)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+
+		merged := &record{
+			Key:        rec.Key,
+			FID:        fid,
+			Size:       uint32(size),
+			Offset:     offset,
+			Timestamp:  rec.Timestamp,
+			ExpireTime: rec.ExpireTime,
+		}
+		plan.mapping[rec] = merged
+		hints = append(hints, indexItem{record: merged})
+
+		offset += int64(size)
+		stat.TotalSize += int64(size)
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+
+	// 没有用到的预留标识符也需要创建空文件，保证每个标识符都有对应的文件
+	for fid++; fid <= plan.last; fid++ {
+		if file, err = db.openMergeFile(fid); err != nil {
+			return err
+		}
+		hints = nil
+		stat = FileStat{FID: fid}
+		if err := finish(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finishMerge 将合并后的文件移动到数据文件夹，替换索引中的 record 并删除旧的数据文件
+func (db *DB) finishMerge(plan *mergePlan) error {
+	// 先移动提示文件，再移动数据文件，保证数据文件出现时提示文件已经完整
+	for fid := plan.first; fid <= plan.last; fid++ {
+		if err := os.Rename(db.mergeSuffixFunc(fid, indexFileSuffix), db.indexSuffixFunc(fid)); err != nil {
+			return err
+		}
+		if err := os.Rename(db.mergeSuffixFunc(fid, dataFileSuffix), db.dataSuffixFunc(fid)); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDirectory(db.indexDirectory); err != nil {
+		return err
+	}
+	if err := syncDirectory(db.dataDirectory); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(db.mergeDirectory); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.merging = false
+
+	for fid := plan.first; fid <= plan.last; fid++ {
+		file, err := db.openReadOnly(fid)
+		if err != nil {
+			return err
+		}
+		db.fileList[fid] = file
+	}
+
+	for i := range plan.stats {
+		stat := plan.stats[i]
+		db.stats[stat.FID] = &stat
+	}
+
+	// 合并期间没有被修改过的键指向合并后的 record，其余的已经是无效数据
+	for old, merged := range plan.mapping {
+		if db.index.get(old.Key) == old {
+			db.index.put(merged)
+		} else {
+			db.markDead(merged)
+		}
+	}
+
+	for key, versions := range db.history {
+		for i, v := range versions {
+			if merged, ok := plan.mapping[v.rec]; ok {
+				db.history[key][i].rec = merged
+			}
+		}
+	}
+
+	// 旧的数据文件不再参与统计和之后的合并
+	sealed := make(map[int64]bool, len(plan.sealed))
+	for _, fid := range plan.sealed {
+		delete(db.stats, fid)
+		sealed[fid] = true
+	}
+
+	// 过期的 record 已经随旧的数据文件删除，需要的删除标记已经写入合并后的数据文件
+	for key, rec := range db.expired {
+		if sealed[rec.FID] {
+			delete(db.expired, key)
+		}
+	}
+
+	// 事务快照可能还在引用旧的数据文件，等待快照释放后再删除
+	if len(db.snapshots) > 0 {
+		db.obsolete = append(db.obsolete, plan.sealed...)
+	} else if err := db.removeDataFiles(plan.sealed); err != nil {
+		return err
+	}
+
+	// 旧的数据文件删除之后，只被它们引用的字典不再需要
+	return db.pruneDictionaries()
+}
+
+// removeDataFiles 关闭并删除数据文件和对应的提示文件，调用者需要持有写锁
+func (db *DB) removeDataFiles(ids []int64) error {
+	for _, fid := range ids {
+		if file, ok := db.fileList[fid]; ok {
+			_ = file.Close()
+			delete(db.fileList, fid)
+		}
+		if err := os.Remove(db.dataSuffixFunc(fid)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(db.indexSuffixFunc(fid)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// 创建合并文件夹中的数据文件并写入文件头
+func (db *DB) openMergeFile(fid int64) (*os.File, error) {
+	file, err := os.OpenFile(db.mergeSuffixFunc(fid, dataFileSuffix), os.O_RDWR|os.O_CREATE|os.O_TRUNC, Perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := bufToFile(fileHeader(dataMagic, db.dataFlags()), file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// 构建合并文件夹中的文件名 [文件夹 + 版本 + 扩展名]
+func (db *DB) mergeSuffixFunc(fid int64, suffix string) string {
+	return fmt.Sprintf("%s%d%s", db.mergeDirectory, fid, suffix)
+}
+
+// startMerge 启动后台合并数据的协程
+// 设置了 MergeRatio 时定期合并无效数据过多的文件，否则数据文件超过上限时自动合并
+func (db *DB) startMerge(opt Option) {
+	if opt.MergeInterval < 0 {
+		return
+	}
+
+	interval := defaultMergeInterval
+	if opt.MergeInterval > 0 {
+		interval = time.Duration(opt.MergeInterval) * time.Millisecond
+	}
+
+	db.wg.Add(1)
+
+	go func() {
+		defer db.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if db.mergeRatio > 0 || db.dataTotalSize() >= totalDataSize {
+					_ = db.Merge()
+				}
+				if db.vlog.gcRatio > 0 {
+					_ = db.ValueLogGC(db.vlog.gcRatio)
+				}
+			case <-db.closing:
+				return
+			}
+		}
+	}()
+}
+
+// syncDirectory 将文件夹中文件的创建、重命名和删除操作落盘
+func syncDirectory(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// writeFileAtomic 先写入临时文件再重命名，然后同步文件所在的文件夹
+func writeFileAtomic(name string, data []byte) error {
+	file, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, Perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := bufToFile(data, file); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(name))
+}
@@ -1,16 +1,33 @@
 package step
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 )
 
 type Option struct {
-	Directory       string `yaml:"Directory"`       // data directory
-	DataFileMaxSize int64  `yaml:"DataFileMaxSize"` // data file max size
-	Enable          bool   `yaml:"Enable"`          // data whether to enable encryption
-	Secret          string `yaml:"Secret"`          // data encryption key
+	Directory           string          `yaml:"Directory"`           // data directory
+	DataFileMaxSize     int64           `yaml:"DataFileMaxSize"`     // data file max size
+	Enable              bool            `yaml:"Enable"`              // data whether to enable encryption
+	Secret              string          `yaml:"Secret"`              // data encryption key, 16, 24 or 32 bytes
+	Cipher              CipherType      `yaml:"Cipher"`              // data encryption algorithm, AES-GCM by default
+	Keyring             Keyring         `yaml:"Keyring"`             // data encryption keys by ID, Secret is the key with ID 0
+	KeyProvider         KeyProvider     `yaml:"-"`                   // master key provider for envelope encryption, replaces Secret and Keyring
+	Passphrase          string          `yaml:"Passphrase"`          // passphrase of any length, the master key is derived from it with PBKDF2
+	FullEncryption      bool            `yaml:"FullEncryption"`      // encrypt whole records including keys and metadata, and the hint files
+	Compression         CompressionType `yaml:"Compression"`         // value compression codec, no compression by default
+	CompressThreshold   int             `yaml:"CompressThreshold"`   // values smaller than this are stored uncompressed, 0 uses 128 bytes or 16 with a dictionary
+	Index               IndexType       `yaml:"Index"`               // in-memory index type
+	SyncMode            SyncMode        `yaml:"SyncMode"`            // data file fsync policy
+	SyncInterval        int64           `yaml:"SyncInterval"`        // background fsync interval in milliseconds
+	MergeInterval       int64           `yaml:"MergeInterval"`       // background merge check interval in milliseconds, negative disables it
+	MergeRatio          float64         `yaml:"MergeRatio"`          // garbage ratio of a data file that makes it a merge candidate, 0 merges all files
+	ValueLogThreshold   int             `yaml:"ValueLogThreshold"`   // values of at least this size are stored in the value log, 0 disables it
+	ValueLogFileMaxSize int64           `yaml:"ValueLogFileMaxSize"` // value log file max size
+	ValueLogGCRatio     float64         `yaml:"ValueLogGCRatio"`     // garbage ratio of a value log file collected in the background at MergeInterval, 0 disables it
+	Codec               Codec           `yaml:"-"`                   // value codec used by Marshal and Data.Unwrap, BSON by default
 }
 
 var (
@@ -21,40 +38,125 @@ var (
 	}
 )
 
-// Validation 做一些初始化工作
-func (o *Option) Validation() {
+// Validation 检查选项并做一些初始化工作
+func (o *Option) Validation() error {
 
 	// 目录为空的情况
 	if o.Directory == "" {
-		panic("The data file directory cannot be empty!!!")
+		return errors.New("the data file directory cannot be empty")
 	}
 
+	// 剔除路径前后的空格
+	o.Directory = strings.TrimSpace(o.Directory)
+
 	// 判断字符串是否以 / 结尾
 	o.Directory = pathBackslashes(o.Directory)
 
-	// 剔除路径前后的空格
-	o.Directory = strings.TrimSpace(o.Directory)
+	// 检查内存索引的类型
+	if o.Index != HashIndex && o.Index != OrderedIndex {
+		return errors.New("unsupported in-memory index type")
+	}
+
+	// 检查刷盘策略
+	if o.SyncMode > SyncInterval {
+		return errors.New("unsupported sync mode")
+	}
+
+	if o.SyncInterval < 0 {
+		return errors.New("the sync interval cannot be negative")
+	}
+
+	// 检查压缩选项
+	if o.Compression > DictCompression {
+		return errors.New("unsupported compression type")
+	}
+
+	if o.CompressThreshold < 0 {
+		return errors.New("the compression threshold cannot be negative")
+	}
+
+	// 检查合并阈值
+	if o.MergeRatio < 0 || o.MergeRatio > 1 {
+		return errors.New("the merge ratio must be between 0 and 1")
+	}
+
+	// 检查值日志选项
+	if o.ValueLogThreshold < 0 || o.ValueLogFileMaxSize < 0 {
+		return errors.New("the value log threshold and file size cannot be negative")
+	}
 
-	// 初始化数据根目录
-	Root = o.Directory
+	if o.ValueLogGCRatio < 0 || o.ValueLogGCRatio > 1 {
+		return errors.New("the value log garbage ratio must be between 0 and 1")
+	}
+
+	if o.Passphrase != "" && !o.Enable {
+		return errors.New("the passphrase requires encryption to be enabled")
+	}
 
-	// 初始化文件最大尺寸
-	if o.DataFileMaxSize != 0 {
-		defaultMaxFileSize = o.DataFileMaxSize
+	// 整体加密依赖 AES-GCM 的认证检查不完整的记录
+	if o.FullEncryption && (!o.Enable || o.Cipher != AESGCM) {
+		return errors.New("full encryption requires encryption to be enabled with AES-GCM")
 	}
 
 	// 是否启用加密功能
 	if o.Enable {
-		if len(o.Secret) < 16 && len(o.Secret) > 16 {
-			panic("The encryption key contains less than 16 characters!!!")
+		if o.Cipher != AESGCM && o.Cipher != AESCBC {
+			return errors.New("unsupported encryption cipher")
+		}
+		if o.Passphrase != "" {
+			return o.checkPassphrase()
+		}
+		if o.KeyProvider != nil {
+			return o.checkKeyProvider()
 		}
-		Secret = []byte(o.Secret)
-		encoder = AES()
+		if _, ok := o.Keyring.Keys[0]; ok && o.Secret != "" {
+			return errors.New("the secret conflicts with the encryption key 0 in the keyring")
+		}
+		keys := o.keys()
+		// AES 的密钥长度只能是 16、24 或者 32 字节
+		for id, key := range keys {
+			if !validKeySize(key) {
+				return fmt.Errorf("the encryption key %d must be 16, 24 or 32 bytes", id)
+			}
+		}
+		if _, ok := keys[o.Keyring.Current]; !ok {
+			return fmt.Errorf("the current encryption key %d is not in the keyring", o.Keyring.Current)
+		}
+	}
+
+	return nil
+}
+
+// checkKeyProvider 检查信封加密的选项，数据密钥由 KeyProvider 管理
+func (o *Option) checkKeyProvider() error {
+	if o.Secret != "" || len(o.Keyring.Keys) > 0 {
+		return errors.New("the key provider cannot be used with a secret or a keyring")
 	}
+	// 主密钥不能和被它保护的数据放在一起
+	if p, ok := o.KeyProvider.(FileKeyProvider); ok && insideDirectory(p.Path, o.Directory) {
+		return errors.New("the master key file cannot be inside the data directory")
+	}
+	return nil
+}
 
-	dataDirectory = fmt.Sprintf("%sdata/", Root)
+// checkPassphrase 检查口令加密的选项，主密钥由口令派生，数据密钥保存在数据目录中
+func (o *Option) checkPassphrase() error {
+	if o.Secret != "" || len(o.Keyring.Keys) > 0 || o.KeyProvider != nil {
+		return errors.New("the passphrase cannot be used with a secret, a keyring or a key provider")
+	}
+	return nil
+}
 
-	indexDirectory = fmt.Sprintf("%sindex/", Root)
+// keys 合并 Secret 和密钥环中的所有密钥
+func (o *Option) keys() map[uint32][]byte {
+	keys := make(map[uint32][]byte, len(o.Keyring.Keys)+1)
+	for id, key := range o.Keyring.Keys {
+		keys[id] = []byte(key)
+	}
+	if o.Secret != "" {
+		keys[0] = []byte(o.Secret)
+	}
+	return keys
 }
 
 // 判断字符串是否以 / 结尾
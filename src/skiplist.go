@@ -0,0 +1,135 @@
+package step
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const (
+	// skipListMaxLevel 跳表的最大层数
+	skipListMaxLevel = 32
+	// skipListP 节点晋升到上一层的概率
+	skipListP = 0.25
+)
+
+// skipListNode 跳表中的节点
+type skipListNode struct {
+	rec  *record
+	next []*skipListNode
+}
+
+// skipList 基于跳表实现的有序内存索引 [key -> record]
+type skipList struct {
+	head  *skipListNode
+	level int
+	size  int
+	rand  *rand.Rand
+}
+
+// newSkipList 创建一个空的跳表索引
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// randomLevel 随机生成新节点的层数
+func (s *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual 找到第一个键大于等于 key 的节点
+// update 不为 nil 时记录每一层中位于该节点之前的节点
+func (s *skipList) findGreaterOrEqual(key []byte, update []*skipListNode) *skipListNode {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && bytes.Compare(node.next[i].rec.Key, key) < 0 {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (s *skipList) get(key []byte) *record {
+	if node := s.findGreaterOrEqual(key, nil); node != nil && bytes.Equal(node.rec.Key, key) {
+		return node.rec
+	}
+	return nil
+}
+
+func (s *skipList) put(rec *record) {
+	update := make([]*skipListNode, skipListMaxLevel)
+
+	if node := s.findGreaterOrEqual(rec.Key, update); node != nil && bytes.Equal(node.rec.Key, rec.Key) {
+		node.rec = rec
+		return
+	}
+
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+
+	node := &skipListNode{rec: rec, next: make([]*skipListNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+
+	s.size++
+}
+
+func (s *skipList) remove(key []byte) {
+	update := make([]*skipListNode, skipListMaxLevel)
+
+	node := s.findGreaterOrEqual(key, update)
+	if node == nil || !bytes.Equal(node.rec.Key, key) {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+
+	s.size--
+}
+
+func (s *skipList) len() int {
+	return s.size
+}
+
+func (s *skipList) iterate(fn func(rec *record) bool) {
+	s.ascend(nil, nil, fn)
+}
+
+func (s *skipList) ascend(start, end []byte, fn func(rec *record) bool) {
+	node := s.head.next[0]
+	if start != nil {
+		node = s.findGreaterOrEqual(start, nil)
+	}
+
+	for ; node != nil; node = node.next[0] {
+		if end != nil && bytes.Compare(node.rec.Key, end) >= 0 {
+			return
+		}
+		if !fn(node.rec) {
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package step
+
+import (
+	"sort"
+	"time"
+)
+
+// FileStat 数据文件的空间使用情况
+type FileStat struct {
+	FID       int64 // 数据文件的标识符
+	TotalSize int64 // 数据文件的大小
+	DeadSize  int64 // 被覆盖、删除和过期的数据的大小
+}
+
+// GarbageRatio 返回数据文件中无效数据所占的比例
+func (s FileStat) GarbageRatio() float64 {
+	if s.TotalSize == 0 {
+		return 0
+	}
+	return float64(s.DeadSize) / float64(s.TotalSize)
+}
+
+// Stats 返回每个数据文件的空间使用情况，按照标识符从小到大排列
+func (db *DB) Stats() []FileStat {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.sweepExpired()
+
+	stats := make([]FileStat, 0, len(db.stats))
+	for _, stat := range db.stats {
+		stats = append(stats, *stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].FID < stats[j].FID })
+
+	return stats
+}
+
+// fileStat 返回数据文件的空间使用情况，不存在时创建，调用者需要持有写锁
+func (db *DB) fileStat(fid int64) *FileStat {
+	stat, ok := db.stats[fid]
+	if !ok {
+		stat = &FileStat{FID: fid}
+		db.stats[fid] = stat
+	}
+	return stat
+}
+
+// markDead 将 record 占用的空间记为无效数据，调用者需要持有写锁
+func (db *DB) markDead(rec *record) {
+	if rec == nil {
+		return
+	}
+	if stat, ok := db.stats[rec.FID]; ok {
+		stat.DeadSize += int64(rec.Size)
+	}
+}
+
+// sweepExpired 从索引中移除已经过期的 record 并记为无效数据，调用者需要持有写锁
+func (db *DB) sweepExpired() {
+	var (
+		expired []*record
+		now     = uint64(time.Now().UnixNano())
+	)
+
+	db.index.iterate(func(rec *record) bool {
+		if rec.expired(now) {
+			expired = append(expired, rec)
+		}
+		return true
+	})
+
+	for _, rec := range expired {
+		db.index.remove(rec.Key)
+		db.markDead(rec)
+		db.expired[string(rec.Key)] = rec
+	}
+}
+
+// rebuildStats 根据数据文件的大小和索引中有效的 record 重新计算空间使用情况
+func (db *DB) rebuildStats() error {
+	db.stats = make(map[int64]*FileStat)
+
+	ids, err := db.dataFileIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, fid := range ids {
+		file, err := db.openReadOnly(fid)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+
+		// 文件头不属于任何记录，不计入统计
+		size := info.Size() - dataOffset(file.version)
+		if size < 0 {
+			size = 0
+		}
+
+		stat := db.fileStat(fid)
+		stat.TotalSize = size
+		stat.DeadSize = size
+	}
+
+	db.index.iterate(func(rec *record) bool {
+		if stat, ok := db.stats[rec.FID]; ok {
+			stat.DeadSize -= int64(rec.Size)
+		}
+		return true
+	})
+
+	return nil
+}
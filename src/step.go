@@ -1,6 +1,9 @@
 package step
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -16,34 +19,12 @@ import (
 )
 
 var (
-
-	// Secret 加密密钥
-	Secret = []byte("ME:QQ:2420498526")
-
-	// 数据根目录
-	Root = ""
-
 	// 文件最大尺寸
 	// 2 << 8 = 512 << 20 = 536870912 kb
 	defaultMaxFileSize int64 = 2 << 8 << 20
 
-	// 全局数据编码器
-	encoder *Encoder
-
-	// 数据所在的文件夹
-	dataDirectory string
-
-	// 索引所在的文件夹
-	indexDirectory string
-
 	// 默认的 hash 函数
-	HashedFunc Hashed
-
-	// 全局索引 [uint64 -> record]
-	index map[uint64]*record
-
-	// 旧数据的文件描述符
-	fileList map[int64]*os.File
+	HashedFunc = DefaultHashFunc()
 
 	// Data recovery triggers the merge threshold
 	// 数据
@@ -55,9 +36,6 @@ var (
 	// 索引文件的扩展名
 	indexFileSuffix = ".index"
 
-	// 当前数据文件的版本
-	dataFileVersion int64 = 0
-
 	// Perm 默认文件权限
 	Perm = os.FileMode(0750)
 
@@ -67,101 +45,318 @@ var (
 	// FR 只读模式下打开文件
 	FR = os.O_RDONLY
 
+	// itemPadding 二进制编码头的填充
+	itemPadding uint32 = 29
+)
+
+// DB 存储引擎的实例句柄，引擎的所有状态都由句柄持有
+// 同一个进程中可以同时打开多个不同目录的 DB
+type DB struct {
 	// 读写互斥锁，只允许一个写，但是允许多个读
 	mutex sync.RWMutex
 
-	// 写入文件的偏移值
-	writeOffset uint32 = 0
+	// 数据根目录
+	root string
+
+	// 数据所在的文件夹
+	dataDirectory string
+
+	// 索引所在的文件夹
+	indexDirectory string
+
+	// 合并数据时临时文件所在的文件夹
+	mergeDirectory string
+
+	// 文件最大尺寸
+	maxFileSize int64
+
+	// 数据编码器
+	encoder *Encoder
+
+	// hash 函数
+	hashed Hashed
+
+	// 内存索引 [key -> record]
+	index indexer
+
+	// 旧数据的文件描述符
+	fileList map[int64]*dataFile
 
 	// 当前可写的文件
 	active *os.File
 
-	// itemPadding 二进制编码头的填充
-	itemPadding uint32 = 20
-)
+	// 写入文件的偏移值
+	writeOffset int64
 
-var (
-	// 按照指定模式打开数据文件
-	openDataFile = func(flag int, dataFileIdentifier int64) (*os.File, error) {
-		return os.OpenFile(dataSuffixFunc(dataFileIdentifier), flag, Perm)
-	}
+	// 当前数据文件的版本
+	dataFileVersion int64
 
-	// 构建指定的数据文件扩展名 [文件夹 + 版本.data]
-	dataSuffixFunc = func(dataFileIdentifier int64) string {
-		return fmt.Sprintf("%s%d%s", dataDirectory, dataFileIdentifier, dataFileSuffix)
-	}
+	// 当前可写文件中所有记录的索引项，文件关闭时写入提示文件
+	hints []indexItem
+
+	// 已经提交的写操作的版本号
+	seq uint64
+
+	// 正在进行的事务快照 [版本号 -> 事务数量]
+	snapshots map[uint64]int
+
+	// 事务快照存在期间被覆盖或者删除的旧版本 [key -> versions]
+	history map[string][]version
+
+	// 刷盘策略
+	syncMode SyncMode
+
+	// 已经追加到数据文件中的写入次数，用于等待刷盘
+	writes uint64
+
+	// 合并并发写入的刷盘操作
+	group *groupCommit
+
+	// 关闭后台刷盘的协程
+	closing chan struct{}
 
-	// 按照指定模式打开索引文件
-	openIndexFile = func(flag int, dataFileIdentifier int64) (*os.File, error) {
-		return os.OpenFile(indexSuffixFunc(dataFileIdentifier), flag, Perm)
+	// 等待后台协程退出
+	wg sync.WaitGroup
+
+	// 是否正在合并数据
+	merging bool
+
+	// 已经合并但是仍然被事务快照引用的数据文件，快照释放后删除
+	obsolete []int64
+
+	// 信封加密时管理主密钥，数据密钥保存在数据目录中
+	keyProvider KeyProvider
+
+	// 从口令派生主密钥的参数
+	kdf *kdfParams
+
+	// 每个数据文件的空间使用情况 [fid -> stat]
+	stats map[int64]*FileStat
+
+	// 已经从索引中移除但是仍然留在数据文件中的过期 record [key -> record]
+	// 它们覆盖了更早的数据文件中的旧数据，合并时可能需要写入删除标记
+	expired map[string]*record
+
+	// 数据文件中无效数据超过该比例时参与合并
+	mergeRatio float64
+
+	// 保存较大的值的值日志
+	vlog *valueLog
+
+	// 值的序列化方式
+	codec Codec
+
+	// 旧格式的数据目录中最新的索引快照
+	legacy *legacySnapshot
+}
+
+// 按照指定模式打开数据文件
+func (db *DB) openDataFile(flag int, dataFileIdentifier int64) (*os.File, error) {
+	return os.OpenFile(db.dataSuffixFunc(dataFileIdentifier), flag, Perm)
+}
+
+// 构建指定的数据文件扩展名 [文件夹 + 版本.data]
+func (db *DB) dataSuffixFunc(dataFileIdentifier int64) string {
+	return fmt.Sprintf("%s%d%s", db.dataDirectory, dataFileIdentifier, dataFileSuffix)
+}
+
+// 以只读模式打开数据文件并读取它的格式版本
+func (db *DB) openReadOnly(dataFileIdentifier int64) (*dataFile, error) {
+	file, err := db.openDataFile(FR, dataFileIdentifier)
+	if err != nil {
+		return nil, err
 	}
 
-	// 构建指定的索引文件扩展名 [文件夹 + 版本.index]
-	indexSuffixFunc = func(dataFileIdentifier int64) string {
-		return fmt.Sprintf("%s%d%s", indexDirectory, dataFileIdentifier, indexFileSuffix)
+	version, flags, err := readFileHeader(file, dataMagic)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
 	}
-)
+
+	return &dataFile{File: file, version: version, flags: flags}, nil
+}
+
+// 按照指定模式打开索引文件
+func (db *DB) openIndexFile(flag int, dataFileIdentifier int64) (*os.File, error) {
+	return os.OpenFile(db.indexSuffixFunc(dataFileIdentifier), flag, Perm)
+}
+
+// Index file item encoding used
+// 每一个索引项对应数据文件中的一条记录
+type indexItem struct {
+	flag uint8
+	*record
+}
+
+// 构建指定的索引文件扩展名 [文件夹 + 版本.index]
+func (db *DB) indexSuffixFunc(dataFileIdentifier int64) string {
+	return fmt.Sprintf("%s%d%s", db.indexDirectory, dataFileIdentifier, indexFileSuffix)
+}
 
 // record Mapping Data Record
 type record struct {
+	Key        []byte // data record key
 	FID        int64  // data file id
 	Size       uint32 // data record size
-	Offset     uint32 // data record offset
-	Timestamp  uint32 // data record create timestamp
-	ExpireTime uint32 // data record expire time
+	Offset     int64  // data record offset
+	Timestamp  uint64 // data record create timestamp in nanoseconds
+	ExpireTime uint64 // data record expire time in nanoseconds, 0 never expires
+}
+
+// expired 判断 record 在 now 时刻是否已经过期
+func (r *record) expired(now uint64) bool {
+	return expiredAt(r.ExpireTime, now)
+}
+
+// expiredAt 判断过期时间为 expire 的数据在 now 时刻是否已经过期
+func expiredAt(expire, now uint64) bool {
+	return expire != 0 && expire <= now
 }
 
 // Close shut down the storage engine and flush the data
-func Close() error {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (db *DB) Close() error {
+	// 停止后台刷盘的协程
+	select {
+	case <-db.closing:
+	default:
+		close(db.closing)
+	}
+	db.wg.Wait()
 
-	if err := active.Sync(); err != nil {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if err := db.active.Sync(); err != nil {
 		return err
 	}
 
-	for _, file := range fileList {
+	if db.vlog.active != nil {
+		if err := db.vlog.active.Sync(); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range db.fileList {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range db.vlog.files {
 		if err := file.Close(); err != nil {
 			return err
 		}
 	}
 
-	return saveIndexToFile()
+	return nil
 }
 
 // Get 获得指定键的数据对象
-func Get(key []byte) (data *Data) {
-	data = &Data{}
-	mutex.RLock()
-	defer mutex.RUnlock()
+func (db *DB) Get(key []byte) (data *Data) {
+	data = &Data{codec: db.codec}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-	sum64 := HashedFunc.Sum64(key)
+	rec := db.index.get(key)
 
-	if index[sum64] == nil {
+	if rec == nil {
 		data.Err = errors.New("the current key does not exist")
 		return
 	}
 
-	if index[sum64].ExpireTime <= uint32(time.Now().Unix()) {
+	if rec.expired(uint64(time.Now().UnixNano())) {
 		data.Err = errors.New("the current key has expired")
 		return
 	}
 
-	item, err := encoder.Read(index[sum64])
+	item, err := db.read(rec)
 	if err != nil {
 		data.Err = err
 		return
 	}
+
+	// 校验数据文件中记录的键，防止读取到其他键的数据
+	if !bytes.Equal(item.Key, key) {
+		data.Err = errors.New("the data record does not match the current key")
+		return
+	}
 	data.Item = item
 	return
 }
 
+// Len 返回存储引擎中没有过期的键的数量
+func (db *DB) Len() int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var (
+		count int
+		now   = uint64(time.Now().UnixNano())
+	)
+
+	db.index.iterate(func(rec *record) bool {
+		if !rec.expired(now) {
+			count++
+		}
+		return true
+	})
+
+	return count
+}
+
+// Keys 返回存储引擎中所有没有过期的键
+func (db *DB) Keys() [][]byte {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var (
+		keys = make([][]byte, 0, db.index.len())
+		now  = uint64(time.Now().UnixNano())
+	)
+
+	db.index.iterate(func(rec *record) bool {
+		if !rec.expired(now) {
+			keys = append(keys, append([]byte(nil), rec.Key...))
+		}
+		return true
+	})
+
+	return keys
+}
+
+// ForEach 遍历存储引擎中所有没有过期的键值对，fn 返回错误时停止遍历并返回该错误
+// 遍历期间持有读锁，fn 中不能对同一个 DB 进行写操作
+func (db *DB) ForEach(fn func(key, value []byte) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var (
+		err error
+		now = uint64(time.Now().UnixNano())
+	)
+
+	db.index.iterate(func(rec *record) bool {
+		if rec.expired(now) {
+			return true
+		}
+
+		var item *Item
+		if item, err = db.read(rec); err != nil {
+			return false
+		}
+
+		err = fn(item.Key, item.Value)
+		return err == nil
+	})
+
+	return err
+}
+
 // Put 将 KV 加入存储引擎中
 // actionFunc 设置了超时时间
-func Put(key, value []byte, actionFunc ...func(action *Action)) (err error) {
+func (db *DB) Put(key, value []byte, actionFunc ...func(action *Action)) (err error) {
 	var (
 		action Action
-		size   int
 	)
 
 	if len(actionFunc) > 0 {
@@ -170,57 +365,153 @@ func Put(key, value []byte, actionFunc ...func(action *Action)) (err error) {
 		}
 	}
 
-	fileInfo, _ := active.Stat()
+	item := NewItem(key, value, uint64(time.Now().UnixNano()))
+	item.ExpireTime = action.expireTime()
 
-	if fileInfo.Size() >= defaultMaxFileSize {
-		if err := closeActiveFile(); err != nil {
-			return err
+	ticket, err := db.put(item)
+	if err != nil {
+		return err
+	}
+
+	// 等待写入的数据按照刷盘策略落盘
+	return db.sync(ticket)
+}
+
+// 写入 item 并更新索引，返回本次写入的序号
+func (db *DB) put(item *Item) (uint64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	rec, err := db.write(item)
+	if err != nil {
+		return 0, err
+	}
+
+	db.seq++
+	db.setIndex(item.Key, rec)
+
+	return db.writes, nil
+}
+
+// 将 item 追加到可写文件中并返回对应的 record，调用者需要持有写锁
+func (db *DB) write(item *Item) (*record, error) {
+	recs, err := db.writeItems([]*Item{item})
+	if err != nil {
+		return nil, err
+	}
+	return recs[0], nil
+}
+
+// 将多个 item 编码后通过一次写入追加到可写文件中，调用者需要持有写锁
+func (db *DB) writeItems(items []*Item) ([]*record, error) {
+	if int64(db.writeOffset) >= db.maxFileSize {
+		if err := db.closeActiveFile(); err != nil {
+			return nil, err
 		}
 
-		if err := createActiveFile(); err != nil {
-			return err
+		if err := db.createActiveFile(); err != nil {
+			return nil, err
 		}
 	}
 
-	sum64 := HashedFunc.Sum64(key)
+	var (
+		buf  []byte
+		recs = make([]*record, 0, len(items))
+	)
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	for _, item := range items {
+		// 较大的值先写入值日志
+		if err := db.separateValue(item); err != nil {
+			return nil, err
+		}
 
-	timestamp := time.Now().Unix()
+		data, err := db.encoder.encode(item)
+		if err != nil {
+			return nil, err
+		}
 
-	if size, err = encoder.Write(NewItem(key, value, uint64(timestamp)), active); err != nil {
-		return err
+		recs = append(recs, &record{
+			Key:        append([]byte(nil), item.Key...),
+			FID:        db.dataFileVersion,
+			Size:       uint32(len(data)),
+			Offset:     db.writeOffset + int64(len(buf)),
+			Timestamp:  item.TimeStamp,
+			ExpireTime: item.ExpireTime,
+		})
+
+		buf = append(buf, data...)
 	}
 
-	index[sum64] = &record{
-		FID:        dataFileVersion,
-		Size:       uint32(size),
-		Offset:     writeOffset,
-		Timestamp:  uint32(timestamp),
-		ExpireTime: uint32(action.TTL.Unix()),
+	if _, err := bufToFile(buf, db.active); err != nil {
+		return nil, err
 	}
 
-	writeOffset += uint32(size)
+	db.writeOffset += int64(len(buf))
+	db.writes++
 
-	return nil
+	// 删除标记和提交标记不会被索引引用，写入时就是无效数据
+	stat := db.fileStat(db.dataFileVersion)
+	stat.TotalSize += int64(len(buf))
+	for i, item := range items {
+		if item.Flag&(flagTombstone|flagBatchCommit) != 0 {
+			stat.DeadSize += int64(recs[i].Size)
+		}
+	}
+
+	for i, item := range items {
+		// 提交标记只在扫描数据文件时使用，不需要写入提示文件
+		if item.Flag&flagBatchCommit != 0 {
+			continue
+		}
+		db.hints = append(db.hints, indexItem{
+			flag:   item.Flag,
+			record: recs[i],
+		})
+	}
+
+	return recs, nil
+}
+
+// 以当前的版本号修改索引中的键，rec 为 nil 时删除该键，调用者需要持有写锁
+// 有事务快照存在时保存被覆盖的旧版本，保证快照读取的一致性
+func (db *DB) setIndex(key []byte, rec *record) {
+	if len(db.snapshots) > 0 {
+		db.history[string(key)] = append(db.history[string(key)], version{
+			rec:   db.index.get(key),
+			until: db.seq,
+		})
+	}
+
+	// 被覆盖或者删除的旧版本成为无效数据
+	db.markDead(db.index.get(key))
+
+	if rec == nil {
+		db.index.remove(key)
+		return
+	}
+
+	db.index.put(rec)
 }
 
-func closeActiveFile() error {
-	mutex.Lock()
-	defer mutex.Unlock()
+// 关闭当前可写文件，调用者需要持有写锁
+func (db *DB) closeActiveFile() error {
+	if err := db.active.Sync(); err != nil {
+		return err
+	}
 
-	if err := active.Sync(); err != nil {
+	if err := db.active.Close(); err != nil {
 		return err
 	}
 
-	if err := active.Close(); err != nil {
+	// 为写满的数据文件生成提示文件，下次启动时无需扫描数据文件
+	if err := db.writeHintFile(db.dataFileVersion, db.hints); err != nil {
 		return err
 	}
+	db.hints = nil
 
 	// 将之前的可写文件设置为只读
-	if file, err := openDataFile(FR, dataFileVersion); err == nil {
-		fileList[dataFileVersion] = file
+	if file, err := db.openReadOnly(db.dataFileVersion); err == nil {
+		db.fileList[db.dataFileVersion] = file
 		return nil
 	}
 
@@ -232,362 +523,539 @@ type Action struct {
 	TTL time.Time // Survival time
 }
 
+// expireTime 返回以纳秒为单位的过期时间，没有设置 TTL 时为 0 表示永不过期
+func (a Action) expireTime() uint64 {
+	if a.TTL.IsZero() {
+		return 0
+	}
+	return uint64(a.TTL.UnixNano())
+}
+
 // Remove removes specified data from storage
-func Remove(key []byte) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	delete(index, HashedFunc.Sum64(key))
+// 删除操作会以删除标记的形式写入数据文件，重建索引时同样生效
+func (db *DB) Remove(key []byte) error {
+	ticket, err := db.remove(key)
+	if err != nil {
+		return err
+	}
+
+	return db.sync(ticket)
 }
 
-// 打开
-func Open(opt Option) error {
+// 写入删除标记并从索引中删除键，返回本次写入的序号
+func (db *DB) remove(key []byte) (uint64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.index.get(key) == nil {
+		return 0, nil
+	}
+
+	item := NewItem(key, nil, uint64(time.Now().UnixNano()))
+	item.Flag = flagTombstone
+
+	if _, err := db.write(item); err != nil {
+		return 0, err
+	}
+
+	db.seq++
+	db.setIndex(key, nil)
+
+	return db.writes, nil
+}
+
+// Open 打开指定目录的存储引擎并返回实例句柄
+func Open(opt Option) (*DB, error) {
 	// 做一些初始化的工作
 	// 例如数据加密加密方式
-	opt.Validation()
+	if err := opt.Validation(); err != nil {
+		return nil, err
+	}
 
 	// 初始化引擎的组件
-	initialize()
+	db := newDB(opt)
 
-	if ok, err := pathExists(Root); ok {
+	if ok, err := pathExists(db.root); ok {
+		// 通过口令或者 KeyProvider 解密数据密钥，口令错误时在这里返回
+		if err := db.initDataKeys(opt); err != nil {
+			return nil, err
+		}
+		// 读取压缩字典
+		if err := db.loadDictionaries(); err != nil {
+			return nil, err
+		}
+		// 打开值日志文件
+		if err := db.openValueLog(); err != nil {
+			return nil, err
+		}
 		// 启动恢复数据
-		return recoverData()
+		if err := db.recoverData(); err != nil {
+			return nil, err
+		}
+		// 根据索引统计每个数据文件中的无效数据
+		if err := db.rebuildStats(); err != nil {
+			return nil, err
+		}
+		// 判断文件是否超过上限(1G)，超过时合并数据
+		if db.dataTotalSize() >= totalDataSize {
+			if err := db.Merge(); err != nil {
+				return nil, err
+			}
+		}
+		db.startSync(opt)
+		db.startMerge(opt)
+		return db, nil
 	} else if err != nil {
 		// 路径是非法的
-		panic("The current path is invalid!!!")
+		return nil, errors.New("the current path is invalid")
 	}
 
 	// 如果数据文件夹不存在就创建
-	if err := os.MkdirAll(dataDirectory, Perm); err != nil {
-		panic("Failed to create a working directory!!!")
+	if err := os.MkdirAll(db.dataDirectory, Perm); err != nil {
+		return nil, errors.New("failed to create a working directory")
 	}
 
 	// 如果索引文件夹不存在就创建
-	if err := os.MkdirAll(indexDirectory, Perm); err != nil {
-		panic("Failed to create a working directory!!!")
+	if err := os.MkdirAll(db.indexDirectory, Perm); err != nil {
+		return nil, errors.New("failed to create a working directory")
+	}
+
+	// 生成第一个数据密钥
+	if err := db.initDataKeys(opt); err != nil {
+		return nil, err
 	}
 
 	// 文件夹创建好，写入数据
-	return createActiveFile()
-}
+	if err := db.createActiveFile(); err != nil {
+		return nil, err
+	}
 
-// 创建一个新的文件
-func createActiveFile() error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	db.startSync(opt)
+	db.startMerge(opt)
 
+	return db, nil
+}
+
+// 创建一个新的文件，调用者需要持有写锁
+func (db *DB) createActiveFile() error {
 	// 初始化可写文件的偏移值和文件标识符
-	writeOffset = 0
-	dataFileVersion++
+	db.dataFileVersion++
 
-	// 打开数据文件
-	if file, err := openDataFile(FRW, dataFileVersion); err == nil {
-		active = file
-		fileList[dataFileVersion] = active
-		return nil
+	// 打开数据文件并写入文件头
+	file, err := db.openDataFile(FRW, db.dataFileVersion)
+	if err != nil {
+		return errors.New("failed to create writable data file")
+	}
+
+	if _, err := bufToFile(fileHeader(dataMagic, db.dataFlags()), file); err != nil {
+		_ = file.Close()
+		return err
 	}
 
-	return errors.New("failed to create writable data file")
+	db.active = file
+	db.writeOffset = fileHeaderSize
+	db.fileList[db.dataFileVersion] = &dataFile{File: file, version: currentFormat, flags: db.dataFlags()}
+	db.fileStat(db.dataFileVersion)
+
+	return nil
 }
 
 // 数据恢复
-func recoverData() error {
+func (db *DB) recoverData() error {
 
-	// 判断文件是否超过上限(1G)
-	if dataTotalSize() >= totalDataSize {
-		// TODO 合并数据
-		if err := migrate(); err != nil {
-			return err
-		}
+	// 清除上次没有完成的合并留下的文件
+	if err := os.RemoveAll(db.mergeDirectory); err != nil {
+		return err
 	}
 
-	// 找到最后一个数据文件，判断是否已满
-	if file, err := findLatestDataFile(); err == nil {
-		info, _ := file.Stat()
-		if info.Size() >= defaultMaxFileSize {
-			if err := createActiveFile(); err != nil {
-				return err
-			}
-			// 当数据已满时，将创建一个新的可写文件并建立一个索引
-			return buildIndex()
-		}
-		// 如果数据文件上次没有被填满
-		// 就会被设置为可写，并计算出可写的偏移量
-		active = file
-		if offset, err := file.Seek(0, os.SEEK_END); err == nil {
-			writeOffset = uint32(offset)
-		}
-		return buildIndex()
+	// 检查文件头，避免按照错误的格式解析文件
+	if err := db.checkFiles(); err != nil {
+		return err
 	}
 
-	return errors.New("failed to restore data")
-}
-
-// 从数据文件中找到最新的数据文件
-func findLatestDataFile() (*os.File, error) {
-	version()
-	return openDataFile(FRW, dataFileVersion)
-}
+	// 旧格式的数据目录中删除和过期时间只保存在索引快照中
+	legacy, err := db.loadLegacySnapshot()
+	if err != nil {
+		return err
+	}
+	db.legacy = legacy
 
-// 合并脏数据
-func migrate() error {
-	// 加载索引和数据
-	if err := buildIndex(); err != nil {
+	// 从提示文件和可写文件中建立索引
+	if err := db.buildIndex(); err != nil {
 		return err
 	}
 
-	// 获取最近的数据版本
-	version()
+	// 数据文件夹中还没有任何数据文件
+	if ids, err := db.dataFileIDs(); err != nil {
+		return err
+	} else if len(ids) == 0 {
+		return db.createActiveFile()
+	}
 
-	var (
-		offset       uint32
-		file         *os.File
-		fileInfo     os.FileInfo
-		excludeFiles []int64
-		activeItem   = make(map[uint64]*Item, len(index))
-	)
+	// 找到最后一个数据文件，判断是否已满
+	file, err := db.findLatestDataFile()
+	if err != nil {
+		return errors.New("failed to restore data")
+	}
 
-	dataFileVersion++
+	// 替换掉建立索引时打开的只读文件描述符
+	if readonly, ok := db.fileList[db.dataFileVersion]; ok {
+		_ = readonly.Close()
+	}
 
-	// 创建用于迁移的目标数据文件
-	file, _ = openDataFile(FRW, dataFileVersion)
-	excludeFiles = append(excludeFiles, dataFileVersion)
-	// 获取 migration 文件的状态
-	fileInfo, _ = file.Stat()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
 
-	// 迁移活跃的可激活数据
-	for idx, rec := range index {
-		item, err := encoder.Read(rec)
-		if err != nil {
+	// 空文件是写入文件头之前异常退出留下的，补齐文件头后继续使用
+	if offset == 0 {
+		if _, err := bufToFile(fileHeader(dataMagic, db.dataFlags()), file); err != nil {
+			_ = file.Close()
 			return err
 		}
+		offset = fileHeaderSize
+	}
 
-		activeItem[idx] = item
+	version, flags, err := readFileHeader(file, dataMagic)
+	if err != nil {
+		_ = file.Close()
+		return err
 	}
 
-	for idx, item := range activeItem {
-		// Check whether the migration file threshold is reached at each turn
-		if fileInfo.Size() >= defaultMaxFileSize {
-			// Close and set too read-only to put into map
-			if err := file.Sync(); err != nil {
-				return err
-			}
-			if err := file.Close(); err != nil {
-				return err
-			}
+	// 数据文件已满、使用旧的格式或者加密算法改变时，创建一个新的可写文件
+	if offset >= db.maxFileSize || version != currentFormat || flags != db.dataFlags() {
+		if err := file.Close(); err != nil {
+			return err
+		}
+		if err := db.writeHintFile(db.dataFileVersion, db.hints); err != nil {
+			return err
+		}
+		db.hints = nil
+		if readonly, err := db.openReadOnly(db.dataFileVersion); err == nil {
+			db.fileList[db.dataFileVersion] = readonly
+		}
+		return db.createActiveFile()
+	}
 
-			// The update operation
-			dataFileVersion++
-			excludeFiles = append(excludeFiles, dataFileVersion)
+	// 如果数据文件上次没有被填满
+	// 就会被设置为可写，并计算出可写的偏移量
+	db.active = file
+	db.fileList[db.dataFileVersion] = &dataFile{File: file, version: version, flags: flags}
+	db.writeOffset = offset
 
-			file, _ = openDataFile(FRW, dataFileVersion)
-			fileInfo, _ = file.Stat()
-			offset = 0
-		}
+	return nil
+}
 
-		// Write the original content to the new file
-		size, err := encoder.Write(item, file)
+// 从数据文件中找到最新的数据文件
+func (db *DB) findLatestDataFile() (*os.File, error) {
+	db.version()
+	return db.openDataFile(FRW, db.dataFileVersion)
+}
 
-		if err != nil {
-			return err
-		}
+// 加载数据文件的版本号
+func (db *DB) version() {
+	ids, _ := db.dataFileIDs()
+
+	// 重置文件计数器和可写文件偏移值
+	if len(ids) > 0 {
+		db.dataFileVersion = ids[len(ids)-1]
+	}
+}
+
+// 按照版本号从小到大返回数据文件夹中所有数据文件的标识符
+func (db *DB) dataFileIDs() ([]int64, error) {
+	files, err := ioutil.ReadDir(db.dataDirectory)
+	if err != nil {
+		return nil, err
+	}
 
-		// Update the new file ID and offset
-		index[idx].FID = dataFileVersion
-		index[idx].Size = uint32(size)
-		index[idx].Offset = offset
+	var ids []int64
 
-		offset += uint32(size)
+	// 将 .data 结尾的文件加入 ids 中
+	for _, file := range files {
+		if path.Ext(file.Name()) != dataFileSuffix {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.Split(file.Name(), ".")[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
 	}
 
-	// 清除已删除的数据
-	fileInfos, err := ioutil.ReadDir(dataDirectory)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 
+	return ids, nil
+}
+
+func (db *DB) buildIndex() error {
+	ids, err := db.dataFileIDs()
 	if err != nil {
 		return err
 	}
 
-	// 过滤掉已经迁移的数据文件
-	for _, info := range fileInfos {
-		fileName := fmt.Sprintf("%s%s", dataDirectory, info.Name())
-		for _, excludeFile := range excludeFiles {
-			if fileName != dataSuffixFunc(excludeFile) {
-				if err := os.Remove(fileName); err != nil {
-					return err
+	now := uint64(time.Now().UnixNano())
+
+	for i, fid := range ids {
+		last := i == len(ids)-1
+
+		// 已经写满的数据文件优先从提示文件中加载索引
+		if !last {
+			if items, err := db.readHintFile(fid); err == nil {
+				for _, item := range items {
+					db.applyIndexItem(item, now)
 				}
+				continue
 			}
 		}
-	}
 
-	// 迁移后，保存最新的索引文件
-	return saveIndexToFile()
-}
+		// 没有提示文件或者是最后一个数据文件时，扫描数据文件
+		items, end, err := db.scanDataFile(fid)
 
-// Memory index file item encoding used
-// The size of 288 - bit
-type indexItem struct {
-	idx uint64
-	*record
-}
-
-// 将索引文件保存到数据目录中
-func saveIndexToFile() (err error) {
-	var file *os.File
-	defer func() {
-		if err := file.Sync(); err != nil {
-			return
+		if err == errTornRecord {
+			// 只有最后一个数据文件可能因为异常退出而写入不完整的记录
+			if !last {
+				return fmt.Errorf("data file %d is corrupted at offset %d", fid, end)
+			}
+			if err := os.Truncate(db.dataSuffixFunc(fid), end); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
 		}
-		if err := file.Close(); err != nil {
-			return
+
+		for _, item := range items {
+			db.applyIndexItem(item, now)
 		}
-	}()
 
-	var channel = make(chan indexItem, 1024)
+		if last {
+			db.hints = items
+		} else if err := db.writeHintFile(fid, items); err != nil {
+			return err
+		}
+	}
 
-	go func() {
-		for sum64, record := range index {
-			channel <- indexItem{
-				idx:    sum64,
-				record: record,
+	// 从索引中找到数据并读取文件描述符
+	db.index.iterate(func(record *record) bool {
+		// https://stackoverflow.com/questions/37804804/too-many-open-file-error-in-golang
+		if db.fileList[record.FID] == nil {
+			var file *dataFile
+			if file, err = db.openReadOnly(record.FID); err != nil {
+				return false
 			}
+			// Open the original data file
+			db.fileList[record.FID] = file
 		}
-		close(channel)
-	}()
+		return true
+	})
 
-	if file, err = openIndexFile(FRW, time.Now().Unix()); err != nil {
-		return
-	}
+	return err
+
+}
 
-	for v := range channel {
-		if _, err = encoder.WriteIndex(v, file); err != nil {
-			return
+// 按照数据文件中的写入顺序应用索引项，后写入的记录覆盖先写入的记录
+func (db *DB) applyIndexItem(item indexItem, now uint64) {
+	// 删除标记和已经过期的记录都会使之前的记录失效
+	if item.flag&flagTombstone != 0 || item.expired(now) {
+		db.index.remove(item.Key)
+		delete(db.expired, string(item.Key))
+		if item.flag&flagTombstone == 0 {
+			db.expired[string(item.Key)] = item.record
 		}
+		return
 	}
 
-	return
+	delete(db.expired, string(item.Key))
+	db.index.put(item.record)
 }
 
-// 加载数据文件的版本号
-func version() {
-	files, _ := ioutil.ReadDir(dataDirectory)
-	var datafiles []fs.FileInfo
+// 扫描一个数据文件中的所有记录，返回记录的索引项和最后一条完整记录的结束位置
+func (db *DB) scanDataFile(fid int64) ([]indexItem, int64, error) {
+	var (
+		items  []indexItem
+		offset int64
+	)
 
-	// 将 .data 结尾的文件加入 datafiles 中
-	for _, file := range files {
-		if path.Ext(file.Name()) == dataFileSuffix {
-			datafiles = append(datafiles, file)
-		}
+	file, err := db.openReadOnly(fid)
+	if err != nil {
+		return nil, offset, err
 	}
+	defer file.Close()
 
-	var ids []int
-
-	for _, info := range datafiles {
-		id := strings.Split(info.Name(), ".")[0]
-		i, _ := strconv.Atoi(id)
-		ids = append(ids, i)
-	}
+	var (
+		pending    []indexItem
+		batchStart int64
+	)
 
-	sort.Ints(ids)
+	// 跳过文件头
+	offset = dataOffset(file.version)
 
-	// 重置文件计数器和可写文件偏移值
-	dataFileVersion = int64(ids[len(ids)-1])
-}
+	for {
+		item, size, err := db.encoder.readItemAt(file, offset)
 
-func buildIndex() error {
+		// 没有提交标记的批量写入是不完整的，需要整体丢弃
+		if err == io.EOF && len(pending) > 0 {
+			return items, batchStart, errTornRecord
+		}
+		if err == io.EOF {
+			return items, offset, nil
+		}
+		if err != nil && len(pending) > 0 {
+			return items, batchStart, err
+		}
+		if err != nil {
+			return items, offset, err
+		}
 
-	if err := readIndexItem(); err != nil {
-		return err
-	}
+		entry := indexItem{
+			flag: item.Flag,
+			record: &record{
+				Key:        item.Key,
+				FID:        fid,
+				Size:       uint32(size),
+				Offset:     offset,
+				Timestamp:  item.TimeStamp,
+				ExpireTime: item.ExpireTime,
+			},
+		}
 
-	// 从索引中找到数据并读取文件描述符
-	for _, record := range index {
-		// https://stackoverflow.com/questions/37804804/too-many-open-file-error-in-golang
-		if fileList[record.FID] == nil {
-			file, err := openDataFile(FR, record.FID)
-			if err != nil {
-				return err
+		switch {
+		case item.Flag&flagBatchCommit != 0:
+			if len(item.Value) == 4 && int(binary.LittleEndian.Uint32(item.Value)) == len(pending) {
+				items = append(items, pending...)
 			}
-			// Open the original data file
-			fileList[record.FID] = file
+			pending = nil
+		case item.Flag&flagBatch != 0:
+			if len(pending) == 0 {
+				batchStart = offset
+			}
+			pending = append(pending, entry)
+		default:
+			pending = nil
+			// 旧格式的记录是否有效由索引快照决定
+			if file.version == formatV1 && !db.legacy.keep(db.hashed.Sum64(item.Key), entry.record) {
+				break
+			}
+			items = append(items, entry)
 		}
-	}
-
-	return nil
 
+		offset += int64(size)
+	}
 }
 
-// Read index file contents into memory index
-func readIndexItem() error {
-	if file, err := findLatestIndexFile(); err == nil {
-		defer func() {
-			if err := file.Sync(); err != nil {
-				return
-			}
-			if err := file.Close(); err != nil {
-				return
-			}
-		}()
+// 读取数据文件对应的提示文件
+func (db *DB) readHintFile(fid int64) ([]indexItem, error) {
+	file, err := db.openIndexFile(FR, fid)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-		buf := make([]byte, 36)
+	version, flags, err := readFileHeader(file, indexMagic)
+	if err != nil {
+		return nil, err
+	}
 
-		for {
-			_, err := file.Read(buf)
+	// 旧版本没有提示文件，没有文件头的索引文件是整个索引的快照，需要扫描数据文件
+	if version == formatV1 {
+		return nil, fmt.Errorf("%s is not a hint file", file.Name())
+	}
 
-			if err != nil && err != io.EOF {
-				return err
-			}
+	var (
+		items  []indexItem
+		reader = bufio.NewReader(file)
+	)
 
-			if err == io.EOF {
-				break
-			}
+	if _, err := reader.Discard(fileHeaderSize); err != nil {
+		return nil, err
+	}
 
-			if err = encoder.ReadIndex(buf); err != nil {
-				return err
-			}
+	// 整体加密的提示文件需要先解密所有的索引项
+	if flags&fileSealed != 0 {
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
 		}
-
-		return nil
+		plain, err := db.encoder.unseal(data, indexMagic)
+		if err != nil {
+			return nil, err
+		}
+		reader = bufio.NewReader(bytes.NewReader(plain))
 	}
 
-	return errors.New("index reading failed")
+	for {
+		item, err := db.encoder.ReadIndex(reader)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
 }
 
-// 在索引文件夹中找到最新的数据文件
-func findLatestIndexFile() (*os.File, error) {
-	files, err := ioutil.ReadDir(indexDirectory)
+// 为数据文件写入提示文件
+func (db *DB) writeHintFile(fid int64, items []indexItem) error {
+	return db.writeIndexFile(db.indexSuffixFunc(fid), items)
+}
 
+// 将索引项写入指定的文件，先写入临时文件再重命名，避免留下不完整的提示文件
+func (db *DB) writeIndexFile(name string, items []indexItem) error {
+	file, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, Perm)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var indexes []fs.FileInfo
+	var (
+		body  = bytes.NewBuffer(fileHeader(indexMagic, 0))
+		flags uint16
+	)
 
-	for _, file := range files {
-		if path.Ext(file.Name()) == indexFileSuffix {
-			indexes = append(indexes, file)
+	for _, item := range items {
+		if _, err := db.encoder.WriteIndex(item, body); err != nil {
+			_ = file.Close()
+			return err
 		}
 	}
 
-	var ids []int
+	data := body.Bytes()
 
-	for _, info := range indexes {
-		id := strings.Split(info.Name(), ".")[0]
-		i, err := strconv.Atoi(id)
+	// 整体加密时文件头之后的所有索引项一起加密
+	if db.encoder.enable && db.encoder.full {
+		flags = db.dataFlags()
+		sealed, err := db.encoder.seal(data[fileHeaderSize:], indexMagic)
 		if err != nil {
-			return nil, err
+			_ = file.Close()
+			return err
 		}
-		ids = append(ids, i)
+		data = append(fileHeader(indexMagic, flags), sealed...)
 	}
 
-	sort.Ints(ids)
+	if _, err := bufToFile(data, file); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
 
-	return openIndexFile(FR, int64(ids[len(ids)-1]))
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(name+".tmp", name)
 }
 
 // 计算文件夹中数据文件的大小
-func dataTotalSize() int64 {
+func (db *DB) dataTotalSize() int64 {
 
 	// 读取文件夹内的数据
-	files, _ := ioutil.ReadDir(dataDirectory)
+	files, _ := ioutil.ReadDir(db.dataDirectory)
 
 	var datafiles []fs.FileInfo
 
@@ -608,26 +1076,83 @@ func dataTotalSize() int64 {
 	return totalSize
 }
 
-// 初始化引擎的组件
-func initialize() {
+// 根据选项初始化引擎的组件
+func newDB(opt Option) *DB {
+	db := &DB{
+		root:           opt.Directory,
+		dataDirectory:  fmt.Sprintf("%sdata/", opt.Directory),
+		indexDirectory: fmt.Sprintf("%sindex/", opt.Directory),
+		mergeDirectory: fmt.Sprintf("%smerge/", opt.Directory),
+		maxFileSize:    defaultMaxFileSize,
+		hashed:         HashedFunc,
+		encoder:        DefaultEncoder(),
+		// 默认情况下挂载 5 个文件描述符
+		fileList:   make(map[int64]*dataFile, 5),
+		snapshots:  make(map[uint64]int),
+		history:    make(map[string][]version),
+		stats:      make(map[int64]*FileStat),
+		expired:    make(map[string]*record),
+		mergeRatio: opt.MergeRatio,
+		codec:      opt.Codec,
+		vlog: &valueLog{
+			directory:   fmt.Sprintf("%svlog/", opt.Directory),
+			threshold:   opt.ValueLogThreshold,
+			maxFileSize: defaultValueLogFileSize,
+			gcRatio:     opt.ValueLogGCRatio,
+			files:       make(map[int64]*dataFile),
+			streams:     make(map[int64]int),
+		},
+		syncMode: opt.SyncMode,
+		group:    newGroupCommit(),
+		closing:  make(chan struct{}),
+	}
+
+	// 初始化文件最大尺寸
+	if opt.DataFileMaxSize != 0 {
+		db.maxFileSize = opt.DataFileMaxSize
+	}
 
-	// 初始化默认的哈希函数
-	if HashedFunc == nil {
-		HashedFunc = DefaultHashFunc()
+	if opt.ValueLogFileMaxSize != 0 {
+		db.vlog.maxFileSize = opt.ValueLogFileMaxSize
 	}
 
-	// 初始化编码器
-	if encoder == nil {
-		encoder = DefaultEncoder()
+	// 初始化默认的哈希函数
+	if db.hashed == nil {
+		db.hashed = DefaultHashFunc()
 	}
 
 	// 初始化索引
-	if index == nil {
-		index = make(map[uint64]*record)
+	switch opt.Index {
+	case OrderedIndex:
+		db.index = newSkipList()
+	default:
+		db.index = newHashIndex(db.hashed)
+	}
+
+	// 是否启用加密功能
+	if opt.Enable {
+		switch opt.Cipher {
+		case AESCBC:
+			db.encoder = AES(nil)
+		default:
+			db.encoder = GCM(nil)
+		}
+		db.encoder.keyring = newKeyring(opt.Keyring.Current, opt.keys())
+		db.encoder.full = opt.FullEncryption
+		db.keyProvider = opt.KeyProvider
+	}
+
+	// 是否启用压缩功能
+	db.encoder.compression = opt.Compression
+	db.encoder.threshold = opt.CompressThreshold
+	db.encoder.dicts = newDictionaries()
+	if db.encoder.threshold == 0 && opt.Compression == DictCompression {
+		db.encoder.threshold = defaultDictThreshold
+	} else if db.encoder.threshold == 0 {
+		db.encoder.threshold = defaultCompressThreshold
 	}
 
-	// 默认情况下挂载 5 个文件描述符
-	fileList = make(map[int64]*os.File, 5)
+	return db
 }
 
 // DefaultEncoder 关闭 AES 加密方式
@@ -1,9 +1,19 @@
 package step
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -33,8 +43,13 @@ func TestOpen(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := Open(tt.args.opt); (err != nil) != tt.wantErr {
+			db, err := Open(tt.args.opt)
+			if (err != nil) != tt.wantErr {
 				t.Errorf("Open() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				checkErr(t, db.Close())
 			}
 		})
 	}
@@ -48,7 +63,7 @@ type userinfo struct {
 func TestPutANDGet(t *testing.T) {
 	os.RemoveAll("./testdata/")
 
-	err := Open(Option{
+	db, err := Open(Option{
 		Directory:       "./testdata",
 		DataFileMaxSize: defaultMaxFileSize,
 	})
@@ -62,20 +77,19 @@ func TestPutANDGet(t *testing.T) {
 		Age:  22,
 	}
 
-	checkErr(t, Put([]byte("foo"), Bson(&user)))
+	checkErr(t, db.Put([]byte("foo"), Bson(&user)))
 
 	// time.Sleep(5 * time.Second)
 	var u userinfo
 
-	Get([]byte("foo")).Unwrap(&u)
+	checkErr(t, db.Get([]byte("foo")).Unwrap(&u))
 
 	t.Log(u)
-	checkErr(t, Close())
+	checkErr(t, db.Close())
 }
 
 func TestSaveData(t *testing.T) {
-	t.Log(active)
-	err := Open(Option{
+	db, err := Open(Option{
 		Directory:       "./testdata",
 		DataFileMaxSize: defaultMaxFileSize,
 	})
@@ -87,30 +101,1794 @@ func TestSaveData(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		k := fmt.Sprintf("test_key_%d", i)
 		v := fmt.Sprintf("test_value_%d", i)
-		err := Put([]byte(k), []byte(v))
+		err := db.Put([]byte(k), []byte(v))
 		if err != nil {
 			t.Error(err)
 		}
 	}
 
-	err = Close()
+	err = db.Close()
 	if err != nil {
 		t.Error(err)
 	}
 }
 
 func TestRemove(t *testing.T) {
-	os.RemoveAll("./data/")
-	err := Open(DefaultOption)
+	os.RemoveAll("./testdata/")
+	opt := Option{Directory: "./testdata"}
+	db, err := Open(opt)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	err = Put([]byte("key"), []byte("value"))
+	err = db.Put([]byte("key"), []byte("value"))
 	if err != nil {
 		return
 	}
-	Remove([]byte("key"))
-	value := index[HashedFunc.Sum64([]byte("key"))]
+	checkErr(t, db.Remove([]byte("key")))
+	value := db.index.get([]byte("key"))
 	t.Log(value)
-	checkErr(t, Close())
+
+	// 删除标记已经写入数据文件，重新打开后不会恢复已删除的键
+	checkErr(t, db.Close())
+	recovered, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recovered.Get([]byte("key")).IsError() {
+		t.Error("removed key was restored after recovery")
+	}
+
+	checkErr(t, recovered.Close())
+}
+
+func TestMultipleInstances(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	first, err := Open(Option{Directory: "./testdata/first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Open(Option{Directory: "./testdata/second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkErr(t, first.Put([]byte("key"), []byte("first")))
+	checkErr(t, second.Put([]byte("key"), []byte("second")))
+
+	if v := first.Get([]byte("key")).String(); v != "first" {
+		t.Errorf("first.Get() = %q, want %q", v, "first")
+	}
+	if v := second.Get([]byte("key")).String(); v != "second" {
+		t.Errorf("second.Get() = %q, want %q", v, "second")
+	}
+
+	checkErr(t, first.Close())
+	checkErr(t, second.Close())
+}
+
+func TestRecoverData(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata"}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("value_%d", i))))
+	}
+
+	// 模拟进程被杀死之前留下一条不完整的记录，最后一个数据文件在打开时总是会被扫描
+	checkErr(t, db.active.Sync())
+	size := int64(db.writeOffset)
+	if _, err := db.active.Write([]byte("torn")); err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Close())
+
+	recovered, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		want := fmt.Sprintf("value_%d", i)
+		if v := recovered.Get([]byte(fmt.Sprintf("key_%d", i))).String(); v != want {
+			t.Errorf("Get() = %q, want %q", v, want)
+		}
+	}
+
+	if int64(recovered.writeOffset) != size {
+		t.Errorf("torn record was not truncated, offset = %d, want %d", recovered.writeOffset, size)
+	}
+
+	checkErr(t, recovered.Close())
+}
+
+func TestHintFile(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", DataFileMaxSize: 256}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("value_%d", i))))
+	}
+	checkErr(t, db.Remove([]byte("key_0")))
+
+	// 每个写满的数据文件都会生成对应的提示文件
+	for fid := int64(1); fid < db.dataFileVersion; fid++ {
+		if ok, _ := pathExists(db.indexSuffixFunc(fid)); !ok {
+			t.Errorf("hint file for data file %d does not exist", fid)
+		}
+	}
+
+	checkErr(t, db.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !db.Get([]byte("key_0")).IsError() {
+		t.Error("removed key was restored from hint files")
+	}
+
+	for i := 1; i < 50; i++ {
+		want := fmt.Sprintf("value_%d", i)
+		if v := db.Get([]byte(fmt.Sprintf("key_%d", i))).String(); v != want {
+			t.Errorf("Get() = %q, want %q", v, want)
+		}
+	}
+
+	checkErr(t, db.Close())
+}
+
+// collisionHash 所有的键都会得到相同的哈希值
+type collisionHash struct{}
+
+func (collisionHash) Sum64([]byte) uint64 { return 42 }
+
+func TestHashCollision(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata"}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.index = newHashIndex(collisionHash{})
+
+	checkErr(t, db.Put([]byte("foo"), []byte("foo_value")))
+	checkErr(t, db.Put([]byte("bar"), []byte("bar_value")))
+
+	if v := db.Get([]byte("foo")).String(); v != "foo_value" {
+		t.Errorf("Get(foo) = %q, want %q", v, "foo_value")
+	}
+	if v := db.Get([]byte("bar")).String(); v != "bar_value" {
+		t.Errorf("Get(bar) = %q, want %q", v, "bar_value")
+	}
+
+	checkErr(t, db.Remove([]byte("foo")))
+	if !db.Get([]byte("foo")).IsError() {
+		t.Error("removed key is still readable")
+	}
+	if v := db.Get([]byte("bar")).String(); v != "bar_value" {
+		t.Errorf("Get(bar) = %q, want %q", v, "bar_value")
+	}
+
+	checkErr(t, db.Close())
+}
+
+func TestKeysAndForEach(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	db, err := Open(Option{Directory: "./testdata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("value_%d", i))))
+	}
+
+	// 已经过期的键不会被遍历
+	checkErr(t, db.Put([]byte("expired"), []byte("value"), func(action *Action) {
+		action.TTL = time.Now().Add(-time.Second)
+	}))
+
+	if n := db.Len(); n != 10 {
+		t.Errorf("Len() = %d, want %d", n, 10)
+	}
+
+	if keys := db.Keys(); len(keys) != 10 {
+		t.Errorf("len(Keys()) = %d, want %d", len(keys), 10)
+	}
+
+	values := make(map[string]string)
+	checkErr(t, db.ForEach(func(key, value []byte) error {
+		values[string(key)] = string(value)
+		return nil
+	}))
+
+	for i := 0; i < 10; i++ {
+		k, want := fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i)
+		if values[k] != want {
+			t.Errorf("ForEach() value of %s = %q, want %q", k, values[k], want)
+		}
+	}
+
+	stop := errors.New("stop")
+	if err := db.ForEach(func(key, value []byte) error { return stop }); err != stop {
+		t.Errorf("ForEach() error = %v, want %v", err, stop)
+	}
+
+	checkErr(t, db.Close())
+}
+
+func TestScan(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", Index: OrderedIndex}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"user:41:name", "user:42:age", "user:42:name", "user:43:name", "user:42"} {
+		checkErr(t, db.Put([]byte(k), []byte(k)))
+	}
+	checkErr(t, db.Close())
+
+	// 重新打开后从提示文件和数据文件中重建有序索引
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collect := func(it *Iterator, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		checkErr(t, it.Err())
+		return keys
+	}
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{
+			name: "range",
+			got:  collect(db.Scan([]byte("user:42"), []byte("user:43"))),
+			want: []string{"user:42", "user:42:age", "user:42:name"},
+		},
+		{
+			name: "prefix",
+			got:  collect(db.PrefixScan([]byte("user:42:"))),
+			want: []string{"user:42:age", "user:42:name"},
+		},
+		{
+			name: "reverse",
+			got: collect(db.PrefixScan([]byte("user:4"), func(r *Range) {
+				r.Reverse = true
+			})),
+			want: []string{"user:43:name", "user:42:name", "user:42:age", "user:42", "user:41:name"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if fmt.Sprint(tt.got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+
+	// 查询之后删除的键被跳过，覆盖的键返回新的值
+	it, err := db.PrefixScan([]byte("user:42:"))
+	checkErr(t, err)
+	checkErr(t, db.Remove([]byte("user:42:age")))
+	checkErr(t, db.Put([]byte("user:42:name"), []byte("updated")))
+	checkErr(t, db.Put([]byte("user:42:zip"), []byte("new")))
+
+	var got []string
+	for it.Next() {
+		got = append(got, string(it.Key())+"="+string(it.Value()))
+	}
+	checkErr(t, it.Err())
+	if want := []string{"user:42:name=updated"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("iterating after writes got %v, want %v", got, want)
+	}
+
+	checkErr(t, db.Close())
+
+	db, err = Open(Option{Directory: "./testdata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Scan(nil, nil); err == nil {
+		t.Error("Scan() on a hash index should fail")
+	}
+	checkErr(t, db.Close())
+}
+
+func TestWriteBatch(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", Enable: true, Secret: "0123456789abcdef"}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkErr(t, db.Put([]byte("removed"), []byte("value")))
+
+	batch := NewBatch()
+	batch.Put([]byte("foo"), []byte("foo_value"))
+	batch.Put([]byte("bar"), []byte("bar_value"))
+	batch.Delete([]byte("removed"))
+	checkErr(t, db.WriteBatch(batch))
+
+	// 模拟写入批量操作时进程被杀死，只留下没有提交标记的记录
+	checkErr(t, db.active.Sync())
+	size := int64(db.writeOffset)
+	for _, key := range []string{"torn_1", "torn_2"} {
+		item := NewItem([]byte(key), []byte("value"), uint64(time.Now().UnixNano()))
+		item.ExpireTime = uint64(time.Now().Add(time.Hour).UnixNano())
+		item.Flag = flagBatch
+		if _, err := db.encoder.Write(item, db.active); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recovered, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := recovered.Get([]byte("foo")).String(); v != "foo_value" {
+		t.Errorf("Get(foo) = %q, want %q", v, "foo_value")
+	}
+	if v := recovered.Get([]byte("bar")).String(); v != "bar_value" {
+		t.Errorf("Get(bar) = %q, want %q", v, "bar_value")
+	}
+	if !recovered.Get([]byte("removed")).IsError() {
+		t.Error("key deleted in batch was restored")
+	}
+	for _, key := range []string{"torn_1", "torn_2"} {
+		if !recovered.Get([]byte(key)).IsError() {
+			t.Errorf("uncommitted batch key %s was restored", key)
+		}
+	}
+	if int64(recovered.writeOffset) != size {
+		t.Errorf("uncommitted batch was not truncated, offset = %d, want %d", recovered.writeOffset, size)
+	}
+
+	checkErr(t, recovered.Close())
+}
+
+func TestTransaction(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	db, err := Open(Option{Directory: "./testdata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkErr(t, db.Put([]byte("balance"), []byte("100")))
+
+	// 只读事务读取到的是事务开始时的快照
+	checkErr(t, db.View(func(tx *Tx) error {
+		checkErr(t, db.Put([]byte("balance"), []byte("200")))
+		checkErr(t, db.Remove([]byte("balance")))
+
+		if v := tx.Get([]byte("balance")).String(); v != "100" {
+			t.Errorf("tx.Get() = %q, want %q", v, "100")
+		}
+		if err := tx.Put([]byte("balance"), []byte("300")); err == nil {
+			t.Error("tx.Put() in a read-only transaction should fail")
+		}
+		return nil
+	}))
+
+	checkErr(t, db.Put([]byte("balance"), []byte("100")))
+
+	// 读写事务提交后写操作生效
+	checkErr(t, db.Update(func(tx *Tx) error {
+		balance := tx.Get([]byte("balance")).Int()
+		if err := tx.Put([]byte("balance"), []byte(fmt.Sprint(balance+50))); err != nil {
+			return err
+		}
+		if v := tx.Get([]byte("balance")).Int(); v != 150 {
+			t.Errorf("tx.Get() = %d, want %d", v, 150)
+		}
+		return tx.Put([]byte("history"), []byte("+50"))
+	}))
+
+	if v := db.Get([]byte("balance")).Int(); v != 150 {
+		t.Errorf("Get() = %d, want %d", v, 150)
+	}
+
+	// 事务读取的键被其他写操作修改后提交会发生冲突
+	err = db.Update(func(tx *Tx) error {
+		balance := tx.Get([]byte("balance")).Int()
+		checkErr(t, db.Put([]byte("balance"), []byte("0")))
+		return tx.Put([]byte("balance"), []byte(fmt.Sprint(balance+50)))
+	})
+	if err != ErrTxConflict {
+		t.Errorf("Update() error = %v, want %v", err, ErrTxConflict)
+	}
+
+	if v := db.Get([]byte("balance")).Int(); v != 0 {
+		t.Errorf("Get() = %d, want %d", v, 0)
+	}
+
+	checkErr(t, db.Close())
+}
+
+func TestSyncMode(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{
+			name: "always",
+			opt:  Option{Directory: "./testdata/always", SyncMode: SyncAlways},
+		},
+		{
+			name: "interval",
+			opt:  Option{Directory: "./testdata/interval", SyncMode: SyncInterval, SyncInterval: 10},
+		},
+	}
+
+	os.RemoveAll("./testdata/")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(tt.opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 并发的写入共享刷盘操作
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						checkErr(t, db.Put([]byte(fmt.Sprintf("key_%d_%d", i, j)), []byte("value")))
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if tt.opt.SyncMode == SyncAlways && db.group.synced != db.writes {
+				t.Errorf("synced = %d, want %d", db.group.synced, db.writes)
+			}
+
+			if n := db.Len(); n != 160 {
+				t.Errorf("Len() = %d, want %d", n, 160)
+			}
+
+			checkErr(t, db.Close())
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", DataFileMaxSize: 1024}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("key_%d", i%20)), []byte(fmt.Sprintf("value_%d", i))))
+	}
+	checkErr(t, db.Remove([]byte("key_0")))
+
+	before := db.dataTotalSize()
+
+	// 合并期间继续写入
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			checkErr(t, db.Put([]byte(fmt.Sprintf("concurrent_%d", i)), []byte("value")))
+		}
+	}()
+
+	checkErr(t, db.Merge())
+	wg.Wait()
+
+	if after := db.dataTotalSize(); after >= before {
+		t.Errorf("dataTotalSize() after merge = %d, want less than %d", after, before)
+	}
+
+	check := func(db *DB) {
+		if !db.Get([]byte("key_0")).IsError() {
+			t.Error("removed key was restored by merge")
+		}
+		for i := 1; i < 20; i++ {
+			want := fmt.Sprintf("value_%d", 480+i)
+			if v := db.Get([]byte(fmt.Sprintf("key_%d", i))).String(); v != want {
+				t.Errorf("Get() = %q, want %q", v, want)
+			}
+		}
+		if n := db.Len(); n != 119 {
+			t.Errorf("Len() = %d, want %d", n, 119)
+		}
+	}
+
+	check(db)
+	checkErr(t, db.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	checkErr(t, db.Close())
+}
+
+func TestMergeRatio(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", DataFileMaxSize: 1024, MergeRatio: 0.5, MergeInterval: -1}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 冷数据只写一次，热数据反复覆盖
+	checkErr(t, db.Put([]byte("ttl"), []byte("old")))
+	for i := 0; i < 100; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("cold_%d", i)), []byte("value")))
+	}
+	for i := 0; i < 300; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("hot_%d", i%5)), []byte(fmt.Sprintf("value_%d", i))))
+		// 过期的新数据在参与合并的文件中，旧数据在不参与合并的文件中
+		if i == 150 {
+			checkErr(t, db.Put([]byte("ttl"), []byte("new"), func(action *Action) {
+				action.TTL = time.Now().Add(50 * time.Millisecond)
+			}))
+		}
+	}
+	checkErr(t, db.Remove([]byte("cold_0")))
+	time.Sleep(100 * time.Millisecond)
+
+	stats := db.Stats()
+	cold := stats[0]
+	if cold.DeadSize == 0 || cold.GarbageRatio() >= opt.MergeRatio {
+		t.Errorf("Stats()[0] = %+v, want a little garbage", cold)
+	}
+
+	var total int64
+	for _, stat := range stats {
+		total += stat.TotalSize
+	}
+	// 文件头不计入统计
+	if size := db.dataTotalSize() - int64(len(stats))*fileHeaderSize; total != size {
+		t.Errorf("total size of Stats() = %d, want %d", total, size)
+	}
+
+	checkErr(t, db.Merge())
+
+	// 无效数据少的文件不参与合并
+	stats = db.Stats()
+	if stats[0] != cold {
+		t.Errorf("Stats()[0] = %+v, want %+v", stats[0], cold)
+	}
+	// 只有删除标记的文件全部是无效数据
+	for _, stat := range stats {
+		if stat.GarbageRatio() >= opt.MergeRatio && stat.DeadSize < stat.TotalSize {
+			t.Errorf("file %d has garbage ratio %f after merge", stat.FID, stat.GarbageRatio())
+		}
+	}
+
+	check := func(db *DB) {
+		if !db.Get([]byte("cold_0")).IsError() {
+			t.Error("removed key was restored by merge")
+		}
+		if v := db.Get([]byte("ttl")); !v.IsError() {
+			t.Errorf("expired key was restored by merge: %q", v.String())
+		}
+		if v := db.Get([]byte("cold_99")).String(); v != "value" {
+			t.Errorf("Get() = %q, want %q", v, "value")
+		}
+		for i := 0; i < 5; i++ {
+			want := fmt.Sprintf("value_%d", 295+i)
+			if v := db.Get([]byte(fmt.Sprintf("hot_%d", i))).String(); v != want {
+				t.Errorf("Get() = %q, want %q", v, want)
+			}
+		}
+		if n := db.Len(); n != 104 {
+			t.Errorf("Len() = %d, want %d", n, 104)
+		}
+	}
+
+	check(db)
+	checkErr(t, db.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+
+	if stats := db.Stats(); stats[0] != cold {
+		t.Errorf("Stats()[0] after reopen = %+v, want %+v", stats[0], cold)
+	}
+
+	// 重新打开之后再次合并，删除标记仍然需要保留
+	checkErr(t, db.Merge())
+	checkErr(t, db.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	checkErr(t, db.Close())
+}
+
+// legacyRecord 按照 formatV1 编码一条数据记录
+func legacyRecord(key, value string, ts uint32) []byte {
+	buf := make([]byte, legacyItemPadding+len(key)+len(value))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(ts))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(len(value)))
+	copy(buf[legacyItemPadding:], key+value)
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// legacyIndex 按照 formatV1 编码索引快照中的一项
+func legacyIndex(key string, fid int64, ts, expire, size, offset uint32) []byte {
+	buf := make([]byte, legacyIndexSize)
+	binary.LittleEndian.PutUint64(buf[4:12], DefaultHashFunc().Sum64([]byte(key)))
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(fid))
+	binary.LittleEndian.PutUint32(buf[20:24], ts)
+	binary.LittleEndian.PutUint32(buf[24:28], expire)
+	binary.LittleEndian.PutUint32(buf[28:32], size)
+	binary.LittleEndian.PutUint32(buf[32:36], offset)
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func TestLegacyFormat(t *testing.T) {
+	os.RemoveAll("./testdata/")
+	checkErr(t, os.MkdirAll("./testdata/data", Perm))
+	checkErr(t, os.MkdirAll("./testdata/index", Perm))
+
+	ts := uint32(time.Now().Unix()) - 10
+
+	// 关闭时写入的索引快照中没有被删除的 e，b 已经过期
+	a := legacyRecord("a", "1", ts)
+	b := legacyRecord("b", "2", ts)
+	e := legacyRecord("e", "5", ts)
+	checkErr(t, ioutil.WriteFile("./testdata/data/1.data", append(append(a, b...), e...), Perm))
+	index := append(
+		legacyIndex("a", 1, ts, legacyNoExpire, uint32(len(a)), 0),
+		legacyIndex("b", 1, ts, ts-1, uint32(len(b)), uint32(len(a)))...,
+	)
+	checkErr(t, ioutil.WriteFile(fmt.Sprintf("./testdata/index/%d.index", ts+1), index, Perm))
+
+	// 快照之后写入的记录仍然有效，没有写满的旧数据文件不再追加新的记录
+	checkErr(t, ioutil.WriteFile("./testdata/data/2.data", legacyRecord("c", "3", ts+2), Perm))
+
+	opt := Option{Directory: "./testdata"}
+
+	check := func(db *DB) {
+		if v := db.Get([]byte("a")); v.String() != "1" || v.TimeStamp != uint64(ts)*uint64(time.Second) {
+			t.Errorf("Get() = %q at %d, want %q at %d", v.String(), v.TimeStamp, "1", uint64(ts)*uint64(time.Second))
+		}
+		for _, key := range []string{"b", "e"} {
+			if !db.Get([]byte(key)).IsError() {
+				t.Errorf("legacy record %q is readable", key)
+			}
+		}
+		for key, want := range map[string]string{"c": "3", "d": "4"} {
+			if v := db.Get([]byte(key)).String(); v != want {
+				t.Errorf("Get(%q) = %q, want %q", key, v, want)
+			}
+		}
+	}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("d"), []byte("4")))
+
+	if db.dataFileVersion != 3 || db.fileList[2].version != formatV1 {
+		t.Errorf("active file = %d, want a new file after the legacy ones", db.dataFileVersion)
+	}
+
+	check(db)
+	checkErr(t, db.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	checkErr(t, db.Close())
+}
+
+// copyLegacyFixture 将最初版本写入的数据目录 ./data 复制到 ./testdata
+func copyLegacyFixture(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	files := map[string]string{
+		"./data/data/3.data":            "./testdata/data/3.data",
+		"./data/index/1648403695.index": "./testdata/index/1648403695.index",
+	}
+	for src, dst := range files {
+		data, err := ioutil.ReadFile(src)
+		checkErr(t, err)
+		checkErr(t, os.MkdirAll(path.Dir(dst), Perm))
+		checkErr(t, ioutil.WriteFile(dst, data, Perm))
+	}
+}
+
+// TestLegacyFixture 读取最初版本写入的数据目录
+func TestLegacyFixture(t *testing.T) {
+	copyLegacyFixture(t)
+
+	db := newDB(Option{Directory: "./testdata/"})
+	checkErr(t, db.checkFile("./testdata/data/3.data", dataMagic))
+	checkErr(t, db.checkFile("./testdata/index/1648403695.index", indexMagic))
+
+	snapshot, err := db.loadLegacySnapshot()
+	checkErr(t, err)
+	if snapshot == nil || len(snapshot.entries) != 101 || snapshot.time != 1648403695*uint64(time.Second) {
+		t.Fatalf("loadLegacySnapshot() = %+v, want 101 entries at 1648403695", snapshot)
+	}
+
+	file, err := db.openReadOnly(3)
+	checkErr(t, err)
+	item, size, err := readItemAt(file, 0)
+	checkErr(t, file.Close())
+	if err != nil || size != 28 || string(item.Key) != "key" || string(item.Value) != "value" || item.TimeStamp != 1648403695*uint64(time.Second) {
+		t.Fatalf("readItemAt() = %+v, %d, %v", item, size, err)
+	}
+
+	check := func(db *DB) {
+		if v := db.Get([]byte("key")); v.String() != "value" {
+			t.Errorf("Get() = %q, %v, want %q", v.String(), v.Err, "value")
+		}
+		if n := db.Len(); n != 1 {
+			t.Errorf("Len() = %d, want 1", n)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		db, err := Open(Option{Directory: "./testdata", MergeInterval: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		checkErr(t, db.Close())
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata"}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("key"), []byte("value")))
+	checkErr(t, db.Close())
+
+	name := db.dataSuffixFunc(db.dataFileVersion)
+	data, err := ioutil.ReadFile(name)
+	checkErr(t, err)
+
+	future := append([]byte(nil), data...)
+	future[4] = byte(currentFormat + 1)
+
+	tests := []struct {
+		name  string
+		opt   Option
+		files map[string][]byte
+		want  string
+	}{
+		{"encryption mismatch", Option{Directory: "./testdata", Enable: true, Secret: "1234567890123456"}, nil, "is not encrypted"},
+		{"future version", opt, map[string][]byte{name: future}, "unsupported format version"},
+		{"random file", opt, map[string][]byte{"./testdata/data/9.data": []byte("not a data file at all")}, "is not a valid step file"},
+		{"swapped files", opt, map[string][]byte{"./testdata/data/9.data": fileHeader(indexMagic, 0)}, "is not a valid step file"},
+	}
+
+	for _, test := range tests {
+		for file, content := range test.files {
+			checkErr(t, ioutil.WriteFile(file, content, Perm))
+		}
+
+		if _, err := Open(test.opt); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: Open() error = %v, want %q", test.name, err, test.want)
+		}
+
+		os.Remove("./testdata/data/9.data")
+		checkErr(t, ioutil.WriteFile(name, data, Perm))
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get([]byte("key")).String(); v != "value" {
+		t.Errorf("Get() = %q, want %q", v, "value")
+	}
+	checkErr(t, db.Close())
+}
+
+func TestUpgrade(t *testing.T) {
+	os.RemoveAll("./testdata/")
+	os.RemoveAll("./testdata.backup/")
+	defer os.RemoveAll("./testdata.backup/")
+
+	checkErr(t, os.MkdirAll("./testdata/data", Perm))
+	checkErr(t, os.MkdirAll("./testdata/index", Perm))
+
+	ts := uint32(time.Now().Unix())
+
+	var (
+		sealed []byte
+		index  []byte
+	)
+	for i := 0; i < 10; i++ {
+		record := legacyRecord(fmt.Sprintf("key_%d", i), fmt.Sprintf("value_%d", i), ts)
+		index = append(index, legacyIndex(fmt.Sprintf("key_%d", i), 1, ts, legacyNoExpire, uint32(len(record)), uint32(len(sealed)))...)
+		sealed = append(sealed, record...)
+	}
+	// 关闭之前删除的键不在索引快照中
+	sealed = append(sealed, legacyRecord("gone", "value", ts)...)
+	checkErr(t, ioutil.WriteFile("./testdata/data/1.data", sealed, Perm))
+	checkErr(t, ioutil.WriteFile(fmt.Sprintf("./testdata/index/%d.index", ts+1), index, Perm))
+
+	// 最后一个数据文件末尾有不完整的记录
+	active := legacyRecord("key_0", "updated", ts+2)
+	active = append(active, legacyRecord("torn", "value", ts+2)[:10]...)
+	checkErr(t, ioutil.WriteFile("./testdata/data/2.data", active, Perm))
+
+	checkErr(t, Upgrade("./testdata"))
+
+	if ok, _ := pathExists("./testdata.backup/data/1.data"); !ok {
+		t.Error("the original directory was not kept as a backup")
+	}
+
+	db := newDB(Option{Directory: "./testdata/"})
+	if ok, err := db.needUpgrade([]int64{1, 2}); ok || err != nil {
+		t.Errorf("needUpgrade() = %v, %v after upgrade", ok, err)
+	}
+
+	// 已经是当前格式时不做任何事情
+	checkErr(t, Upgrade("./testdata"))
+
+	db, err := Open(Option{Directory: "./testdata"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		want := fmt.Sprintf("value_%d", i)
+		if i == 0 {
+			want = "updated"
+		}
+		if v := db.Get([]byte(fmt.Sprintf("key_%d", i))).String(); v != want {
+			t.Errorf("Get() = %q, want %q", v, want)
+		}
+	}
+	if n := db.Len(); n != 10 {
+		t.Errorf("Len() = %d, want %d", n, 10)
+	}
+	if !db.Get([]byte("gone")).IsError() {
+		t.Error("a key removed before the legacy snapshot was restored by the upgrade")
+	}
+	checkErr(t, db.Close())
+}
+
+func TestUpgradeFixture(t *testing.T) {
+	copyLegacyFixture(t)
+	os.RemoveAll("./testdata.backup/")
+	defer os.RemoveAll("./testdata.backup/")
+
+	// 当前版本打开旧的数据目录后，新的数据写入当前格式的数据文件，较大的值写入值日志
+	opt := Option{Directory: "./testdata", MergeInterval: -1, ValueLogThreshold: 64}
+	large := strings.Repeat("large value;", 20)
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("new"), []byte("value")))
+	checkErr(t, db.Put([]byte("large"), []byte(large)))
+	checkErr(t, db.Close())
+
+	current := db.dataSuffixFunc(db.dataFileVersion)
+	before, err := ioutil.ReadFile(current)
+	checkErr(t, err)
+
+	checkErr(t, Upgrade("./testdata"))
+
+	// 当前格式的数据文件原样复制
+	if after, err := ioutil.ReadFile(current); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("the current format data file was rewritten by the upgrade: %v", err)
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.fileList[3].version != currentFormat {
+		t.Errorf("data file 3 version = %d after upgrade, want %d", db.fileList[3].version, currentFormat)
+	}
+	for key, want := range map[string]string{"key": "value", "new": "value", "large": large} {
+		if v := db.Get([]byte(key)); v.String() != want {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, v.String(), v.Err, want)
+		}
+	}
+	checkErr(t, db.Close())
+}
+
+func TestUpgradeEncrypted(t *testing.T) {
+	os.RemoveAll("./testdata/")
+	os.RemoveAll("./testdata.backup/")
+	defer os.RemoveAll("./testdata.backup/")
+
+	checkErr(t, os.MkdirAll("./testdata/data", Perm))
+	checkErr(t, os.MkdirAll("./testdata/index", Perm))
+
+	secret := "1234567890123456"
+	ts := uint32(time.Now().Unix())
+
+	// 最初版本使用 AES-CBC 加密，没有密钥标识符
+	value, err := aesEncrypt([]byte("value"), []byte(secret))
+	checkErr(t, err)
+	record := legacyRecord("old", string(value), ts)
+	checkErr(t, ioutil.WriteFile("./testdata/data/1.data", record, Perm))
+	index := legacyIndex("old", 1, ts, legacyNoExpire, uint32(len(record)), 0)
+	checkErr(t, ioutil.WriteFile(fmt.Sprintf("./testdata/index/%d.index", ts+1), index, Perm))
+
+	// 新的数据使用 AES-GCM 加密，写入当前格式的数据文件
+	opt := Option{Directory: "./testdata", Enable: true, Secret: secret, MergeInterval: -1}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("new"), []byte("value")))
+	checkErr(t, db.Close())
+
+	checkErr(t, Upgrade("./testdata", func(opt *UpgradeOption) {
+		opt.Encrypted = true
+	}))
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每个文件保留自己的加密方式
+	for key, want := range map[string]uint16{"old": fileEncrypted, "new": fileEncrypted | fileAESGCM | fileKeyID} {
+		if v := db.Get([]byte(key)); v.String() != "value" {
+			t.Errorf("Get(%q) = %q, %v", key, v.String(), v.Err)
+		}
+		if rec := db.index.get([]byte(key)); db.fileList[rec.FID].flags != want {
+			t.Errorf("%q is in a data file with flags %#x, want %#x", key, db.fileList[rec.FID].flags, want)
+		}
+	}
+	checkErr(t, db.Close())
+}
+
+func TestUpgradeSealed(t *testing.T) {
+	os.RemoveAll("./testdata/")
+	os.RemoveAll("./testdata.backup/")
+	defer os.RemoveAll("./testdata.backup/")
+
+	checkErr(t, os.MkdirAll("./testdata/data", Perm))
+	checkErr(t, os.MkdirAll("./testdata/index", Perm))
+
+	secret := "0123456789abcdef"
+	ts := uint32(time.Now().Unix())
+
+	value, err := aesEncrypt([]byte("value"), []byte(secret))
+	checkErr(t, err)
+	record := legacyRecord("old", string(value), ts)
+	checkErr(t, ioutil.WriteFile("./testdata/data/1.data", record, Perm))
+	index := legacyIndex("old", 1, ts, legacyNoExpire, uint32(len(record)), 0)
+	checkErr(t, ioutil.WriteFile(fmt.Sprintf("./testdata/index/%d.index", ts+1), index, Perm))
+
+	// 整体加密的数据文件在升级时原样复制，包括最后一个数据文件
+	opt := Option{Directory: "./testdata", DataFileMaxSize: 256, Enable: true, Secret: secret, FullEncryption: true, MergeInterval: -1}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")))
+	}
+	checkErr(t, db.Close())
+
+	checkErr(t, Upgrade("./testdata", func(opt *UpgradeOption) {
+		opt.Encrypted = true
+	}))
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"old", "key_0", "key_9"} {
+		if v := db.Get([]byte(key)); v.String() != "value" {
+			t.Errorf("Get(%q) = %q, %v", key, v.String(), v.Err)
+		}
+	}
+	if n := db.Len(); n != 11 {
+		t.Errorf("Len() = %d, want %d", n, 11)
+	}
+	checkErr(t, db.Close())
+}
+
+func TestEncryption(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	// 旧的数据使用 AES-CBC 加密
+	opt := Option{Directory: "./testdata", Enable: true, Secret: "1234567890123456", Cipher: AESCBC}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("old"), []byte("value")))
+	checkErr(t, db.Close())
+
+	// 切换为 AES-GCM 之后仍然可以读取旧的数据，合并时重新加密
+	opt.Cipher = AESGCM
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("new"), []byte("value")))
+	checkErr(t, db.Merge())
+
+	for _, key := range []string{"old", "new"} {
+		if v := db.Get([]byte(key)); v.String() != "value" {
+			t.Errorf("Get(%q) = %q, %v", key, v.String(), v.Err)
+		}
+		if rec := db.index.get([]byte(key)); db.fileList[rec.FID].flags&fileAESGCM == 0 {
+			t.Errorf("%q is not encrypted with AES-GCM after merge", key)
+		}
+	}
+
+	// 修改密文并重新计算 CRC，只有认证加密能够发现
+	rec := db.index.get([]byte("new"))
+	data := make([]byte, rec.Size)
+	_, err = db.fileList[rec.FID].ReadAt(data, rec.Offset)
+	checkErr(t, err)
+	data[len(data)-1] ^= 1
+	binary.LittleEndian.PutUint32(data[:4], crc32.ChecksumIEEE(data[4:]))
+
+	file, err := os.OpenFile(db.dataSuffixFunc(rec.FID), os.O_WRONLY, Perm)
+	checkErr(t, err)
+	_, err = file.WriteAt(data, rec.Offset)
+	checkErr(t, err)
+	checkErr(t, file.Close())
+
+	if v := db.Get([]byte("new")); !errors.Is(v.Err, ErrTampered) {
+		t.Errorf("Get() error = %v, want %v", v.Err, ErrTampered)
+	}
+
+	checkErr(t, db.Close())
+}
+
+func TestRotateKey(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	var (
+		oldKey = "1234567890123456"
+		newKey = "abcdefghijklmnopqrstuvwxyz123456"
+	)
+
+	opt := Option{Directory: "./testdata", DataFileMaxSize: 1024, Enable: true, Secret: oldKey, ValueLogThreshold: 64}
+
+	defer func(size int) { streamChunkSize = size }(streamChunkSize)
+	streamChunkSize = 64
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("value_%d", i))))
+	}
+
+	// 值日志中的值和流式写入的数据块也需要使用新的密钥重新加密
+	large := strings.Repeat("large value;", 20)
+	checkErr(t, db.Put([]byte("large"), []byte(large)))
+	checkErr(t, db.PutReader([]byte("stream"), strings.NewReader(large), int64(len(large))))
+
+	if err := db.RotateKey(0, newKey); err == nil {
+		t.Error("RotateKey() replaced an existing key")
+	}
+	checkErr(t, db.RotateKey(1, newKey))
+	checkErr(t, db.Put([]byte("key_0"), []byte("rotated")))
+
+	check := func(db *DB) {
+		for i := 0; i < 100; i++ {
+			want := fmt.Sprintf("value_%d", i)
+			if i == 0 {
+				want = "rotated"
+			}
+			if v := db.Get([]byte(fmt.Sprintf("key_%d", i))); v.String() != want {
+				t.Errorf("Get() = %q, %v, want %q", v.String(), v.Err, want)
+			}
+		}
+		for _, key := range []string{"large", "stream"} {
+			if v := db.Get([]byte(key)); v.String() != large {
+				t.Errorf("Get(%q) = %q, %v", key, v.String(), v.Err)
+			}
+		}
+	}
+
+	check(db)
+	checkErr(t, db.Close())
+
+	// 轮换之后只需要新的密钥
+	db, err = Open(Option{
+		Directory:         "./testdata",
+		DataFileMaxSize:   1024,
+		Enable:            true,
+		Keyring:           Keyring{Current: 1, Keys: map[uint32]string{1: newKey}},
+		ValueLogThreshold: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	checkErr(t, db.Close())
+
+	// 缺少当前密钥的密钥环不能通过检查
+	opt.Keyring = Keyring{Current: 2}
+	if _, err := Open(opt); err == nil {
+		t.Error("Open() accepted a keyring without the current key")
+	}
+}
+
+func TestKeyProvider(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	master := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	name := t.TempDir() + "/master.key"
+	checkErr(t, ioutil.WriteFile(name, []byte(master+"\n"), Perm))
+
+	opt := Option{Directory: "./testdata", Enable: true, KeyProvider: FileKeyProvider{Path: name}}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("key"), []byte("value")))
+
+	// 没有保存到数据目录中的密钥重新打开之后无法提供
+	if err := db.RotateKey(7, "0123456789abcdef"); err == nil {
+		t.Error("RotateKey() accepted a key that is not managed by the key provider")
+	}
+
+	checkErr(t, db.RotateDataKey())
+	checkErr(t, db.Put([]byte("rotated"), []byte("value")))
+	checkErr(t, db.Close())
+
+	// 数据目录中只有被加密的数据密钥
+	keys, err := db.readKeysFile()
+	checkErr(t, err)
+	if len(keys.keys) != 2 {
+		t.Errorf("len(readKeysFile()) = %d, want %d", len(keys.keys), 2)
+	}
+
+	// 环境变量中的同一个主密钥
+	os.Setenv("STEP_TEST_MASTER_KEY", master)
+	defer os.Unsetenv("STEP_TEST_MASTER_KEY")
+
+	db, err = Open(Option{Directory: "./testdata", Enable: true, KeyProvider: EnvKeyProvider{Name: "STEP_TEST_MASTER_KEY"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key", "rotated"} {
+		if v := db.Get([]byte(key)); v.String() != "value" {
+			t.Errorf("Get(%q) = %q, %v", key, v.String(), v.Err)
+		}
+	}
+	checkErr(t, db.Close())
+
+	tests := []struct {
+		name     string
+		provider KeyProvider
+	}{
+		{"wrong master key", EnvKeyProvider{Name: "STEP_TEST_WRONG_KEY"}},
+		{"master key inside the data directory", FileKeyProvider{Path: "./testdata/master.key"}},
+	}
+
+	os.Setenv("STEP_TEST_WRONG_KEY", strings.Repeat("f", 64))
+	defer os.Unsetenv("STEP_TEST_WRONG_KEY")
+	checkErr(t, ioutil.WriteFile("./testdata/master.key", []byte(master), Perm))
+
+	for _, test := range tests {
+		if _, err := Open(Option{Directory: "./testdata", Enable: true, KeyProvider: test.provider}); err == nil {
+			t.Errorf("%s: Open() succeeded", test.name)
+		}
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	// RFC 7914 中 PBKDF2-HMAC-SHA256 的测试向量
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got := fmt.Sprintf("%x", pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)); got != want {
+		t.Errorf("pbkdf2() = %s, want %s", got, want)
+	}
+
+	iterations := defaultKDFIterations
+	defaultKDFIterations = 1000
+	defer func() { defaultKDFIterations = iterations }()
+
+	opt := Option{Directory: "./testdata", Enable: true, Passphrase: "correct horse battery staple"}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.Put([]byte("key"), []byte("value")))
+	checkErr(t, db.RotateDataKey())
+	checkErr(t, db.Close())
+
+	// 盐值和迭代次数保存在数据目录中
+	keys, err := db.readKeysFile()
+	checkErr(t, err)
+	if keys.kdf == nil || keys.kdf.iterations != 1000 || len(keys.kdf.salt) != kdfSaltSize {
+		t.Fatalf("readKeysFile().kdf = %+v", keys.kdf)
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get([]byte("key")); v.String() != "value" {
+		t.Errorf("Get(%q) = %q, %v", "key", v.String(), v.Err)
+	}
+	checkErr(t, db.Close())
+
+	// 错误的口令在打开时返回
+	opt.Passphrase = "wrong"
+	if _, err := Open(opt); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Open() with a wrong passphrase = %v, want %v", err, ErrWrongPassphrase)
+	}
+
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"passphrase without encryption", Option{Directory: "./testdata", Passphrase: "passphrase"}},
+		{"passphrase with a secret", Option{Directory: "./testdata", Enable: true, Passphrase: "passphrase", Secret: "0123456789abcdef"}},
+	}
+
+	for _, test := range tests {
+		if _, err := Open(test.opt); err == nil {
+			t.Errorf("%s: Open() succeeded", test.name)
+		}
+	}
+}
+
+func TestFullEncryption(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", DataFileMaxSize: 256, Enable: true, Secret: "0123456789abcdef", FullEncryption: true}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("secret-key-%d", i)), []byte("secret-value")))
+	}
+	checkErr(t, db.Remove([]byte("secret-key-0")))
+	checkErr(t, db.Close())
+
+	// 数据文件和提示文件中都不能出现明文的键和值
+	var hints int
+	for _, dir := range []string{db.dataDirectory, db.indexDirectory} {
+		files, err := ioutil.ReadDir(dir)
+		checkErr(t, err)
+		for _, file := range files {
+			data, err := ioutil.ReadFile(dir + file.Name())
+			checkErr(t, err)
+			if strings.Contains(string(data), "secret") {
+				t.Errorf("%s contains plaintext", file.Name())
+			}
+			if dir == db.indexDirectory {
+				hints++
+			}
+		}
+	}
+	if hints == 0 {
+		t.Error("no hint files were written")
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get([]byte("secret-key-0")); v.Err == nil {
+		t.Errorf("Get(%q) = %q, want an error", "secret-key-0", v.String())
+	}
+	for i := 1; i < 20; i++ {
+		key := fmt.Sprintf("secret-key-%d", i)
+		if v := db.Get([]byte(key)); v.String() != "secret-value" {
+			t.Errorf("Get(%q) = %q, %v", key, v.String(), v.Err)
+		}
+	}
+	checkErr(t, db.Merge())
+	checkErr(t, db.Close())
+
+	// 错误的密钥在打开时返回，而不是截断数据文件
+	wrong := opt
+	wrong.Secret = "fedcba9876543210"
+	if _, err := Open(wrong); !errors.Is(err, ErrTampered) {
+		t.Errorf("Open() with a wrong secret = %v, want %v", err, ErrTampered)
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get([]byte("secret-key-19")); v.String() != "secret-value" {
+		t.Errorf("Get(%q) = %q, %v", "secret-key-19", v.String(), v.Err)
+	}
+
+	// 最后一个数据文件末尾被篡改的记录不能当作不完整的记录截断
+	checkErr(t, db.Put([]byte("secret-key-20"), []byte("secret-value")))
+	rec := db.index.get([]byte("secret-key-20"))
+	name := db.dataSuffixFunc(rec.FID)
+	checkErr(t, db.Close())
+
+	file, err := os.OpenFile(name, os.O_RDWR, Perm)
+	checkErr(t, err)
+	info, err := file.Stat()
+	checkErr(t, err)
+	_, err = file.WriteAt([]byte{0xff}, info.Size()-1)
+	checkErr(t, err)
+	checkErr(t, file.Close())
+
+	if _, err := Open(opt); !errors.Is(err, ErrTampered) {
+		t.Errorf("Open() with a tampered record = %v, want %v", err, ErrTampered)
+	}
+	if after, err := os.Stat(name); err != nil || after.Size() != info.Size() {
+		t.Errorf("the data file with a tampered record was truncated: %v", err)
+	}
+
+	cbc := opt
+	cbc.Cipher = AESCBC
+	if _, err := Open(cbc); err == nil {
+		t.Error("Open() accepted full encryption with AES-CBC")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	value := strings.Repeat("compressible value ", 100)
+
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"flate", Option{Compression: FlateCompression}},
+		{"gzip", Option{Compression: GzipCompression}},
+		{"lz", Option{Compression: LZCompression}},
+		{"lz with full encryption", Option{Compression: LZCompression, Enable: true, Secret: "0123456789abcdef", FullEncryption: true}},
+	}
+
+	for _, test := range tests {
+		os.RemoveAll("./testdata/")
+
+		opt := test.opt
+		opt.Directory = "./testdata"
+
+		db, err := Open(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkErr(t, db.Put([]byte("large"), []byte(value)))
+		checkErr(t, db.Put([]byte("small"), []byte("small value")))
+
+		// 超过阈值的值压缩后写入
+		if size := db.dataTotalSize(); size >= int64(len(value)) {
+			t.Errorf("%s: dataTotalSize() = %d, want less than %d", test.name, size, len(value))
+		}
+		checkErr(t, db.Merge())
+		checkErr(t, db.Close())
+
+		// 关闭压缩之后仍然能够读取压缩的数据
+		opt.Compression = NoCompression
+		db, err = Open(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{"large": value, "small": "small value"} {
+			if v := db.Get([]byte(key)); v.String() != want {
+				t.Errorf("%s: Get(%q) = %d bytes, %v", test.name, key, len(v.String()), v.Err)
+			}
+		}
+		checkErr(t, db.Close())
+	}
+
+	if _, err := Open(Option{Directory: "./testdata", Compression: CompressionType(100)}); err == nil {
+		t.Error("Open() accepted an unsupported compression type")
+	}
+}
+
+func TestDictCompression(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		os.RemoveAll("./testdata/")
+
+		opt := Option{Directory: "./testdata", Compression: DictCompression, Enable: enable}
+		if enable {
+			opt.Secret = "0123456789abcdef"
+		}
+
+		value := func(i int) []byte {
+			return []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user%d@example.com","active":true}`, i, i, i))
+		}
+
+		db, err := Open(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			checkErr(t, db.Put([]byte(fmt.Sprintf("user-%d", i)), value(i)))
+		}
+
+		// 合并数据时训练字典
+		before := db.dataTotalSize()
+		checkErr(t, db.Merge())
+		if _, ok := db.encoder.dicts.dict(0); !ok {
+			t.Fatal("Merge() did not train a dictionary")
+		}
+		if after := db.dataTotalSize(); after >= before {
+			t.Errorf("dataTotalSize() = %d after merge, want less than %d", after, before)
+		}
+
+		// 样本足够多时重新训练，新的字典使用新的标识符
+		value = func(i int) []byte {
+			if i < 100 {
+				return []byte(fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user%d@example.com","active":true}`, i, i, i))
+			}
+			return []byte(fmt.Sprintf(`<order id="%d" customer="user-%d" status="shipped" carrier="example-express"/>`, i, i))
+		}
+		for i := 100; i < 100+dictRetrainSamples; i++ {
+			checkErr(t, db.Put([]byte(fmt.Sprintf("user-%d", i)), value(i)))
+		}
+		checkErr(t, db.Merge())
+		if db.encoder.dicts.current != 1 || len(db.encoder.dicts.all()) != 2 {
+			t.Errorf("current dictionary = %d of %d after retraining, want 1 of 2", db.encoder.dicts.current, len(db.encoder.dicts.all()))
+		}
+
+		// 所有的记录都使用新的字典重新写入之后，旧的字典被移除
+		checkErr(t, db.Merge())
+		if _, ok := db.encoder.dicts.dict(0); ok {
+			t.Error("the old dictionary was kept after a full merge")
+		}
+
+		// 反复合并相似的数据不会一直增加字典
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 100+dictRetrainSamples; i++ {
+				checkErr(t, db.Put([]byte(fmt.Sprintf("user-%d", i)), value(i)))
+			}
+			checkErr(t, db.Merge())
+			if n := len(db.encoder.dicts.all()); n > 2 {
+				t.Fatalf("round %d: %d dictionaries after merge, want at most 2", round, n)
+			}
+		}
+		checkErr(t, db.Close())
+
+		// 加密时字典中不能出现明文
+		data, err := ioutil.ReadFile("./testdata/" + dictsFileName)
+		checkErr(t, err)
+		if strings.Contains(string(data), "example.com") == enable {
+			t.Errorf("enable = %v: dictionary file contains plaintext = %v", enable, !enable)
+		}
+
+		opt.Compression = NoCompression
+		db, err = Open(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100+dictRetrainSamples; i++ {
+			if v := db.Get([]byte(fmt.Sprintf("user-%d", i))); v.String() != string(value(i)) {
+				t.Errorf("Get(%q) = %q, %v", fmt.Sprintf("user-%d", i), v.String(), v.Err)
+			}
+		}
+		checkErr(t, db.Close())
+	}
+}
+
+func TestValueLog(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", MergeInterval: -1, ValueLogThreshold: 1024, ValueLogFileMaxSize: 32 << 10, Enable: true, Secret: "0123456789abcdef", FullEncryption: true}
+
+	value := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("large value %d;", i), 600))
+	}
+
+	vlogSize := func(db *DB) (size int64) {
+		files, err := ioutil.ReadDir(db.vlog.directory)
+		checkErr(t, err)
+		for _, file := range files {
+			size += file.Size()
+		}
+		return size
+	}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		checkErr(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), value(i)))
+	}
+	checkErr(t, db.Put([]byte("small"), []byte("small value")))
+
+	// 数据文件中只有指向值日志的指针
+	if size := db.dataTotalSize(); size >= int64(len(value(0))) {
+		t.Errorf("dataTotalSize() = %d, want less than one value", size)
+	}
+	before := vlogSize(db)
+
+	// 合并数据文件时不会重写值日志
+	checkErr(t, db.Merge())
+	if size := vlogSize(db); size != before {
+		t.Errorf("value log size = %d after merge, want %d", size, before)
+	}
+
+	for i := 0; i < 15; i++ {
+		checkErr(t, db.Remove([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	checkErr(t, db.ValueLogGC(0.5))
+	if size := vlogSize(db); size >= before {
+		t.Errorf("value log size = %d after garbage collection, want less than %d", size, before)
+	}
+	checkErr(t, db.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 15; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if v := db.Get([]byte(key)); v.String() != string(value(i)) {
+			t.Errorf("Get(%q) = %d bytes, %v", key, len(v.String()), v.Err)
+		}
+	}
+	if v := db.Get([]byte("small")); v.String() != "small value" {
+		t.Errorf("Get(%q) = %q, %v", "small", v.String(), v.Err)
+	}
+
+	// 值日志整体加密
+	files, err := ioutil.ReadDir(db.vlog.directory)
+	checkErr(t, err)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(db.vlog.directory + file.Name())
+		checkErr(t, err)
+		if strings.Contains(string(data), "large value") {
+			t.Errorf("%s contains plaintext", file.Name())
+		}
+	}
+	checkErr(t, db.Close())
+}
+
+func TestValueLogCorrupted(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	opt := Option{Directory: "./testdata", MergeInterval: -1, ValueLogThreshold: 64}
+	value := strings.Repeat("large value;", 20)
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k0", "k1", "k2"} {
+		checkErr(t, db.Put([]byte(key), []byte(value)))
+	}
+	checkErr(t, db.Close())
+
+	// 修改值日志中第一项的值，校验失败的记录之后还有有效的值
+	name := db.vlogSuffixFunc(1)
+	file, err := os.OpenFile(name, os.O_RDWR, Perm)
+	checkErr(t, err)
+	_, err = file.WriteAt([]byte{'X'}, int64(fileHeaderSize+itemPadding+2))
+	checkErr(t, err)
+	checkErr(t, file.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ValueLogGC(0); err == nil {
+		t.Error("ValueLogGC() collected a corrupted value log file")
+	}
+	if ok, _ := pathExists(name); !ok {
+		t.Error("the corrupted value log file was removed")
+	}
+	for _, key := range []string{"k1", "k2"} {
+		if v := db.Get([]byte(key)); v.String() != value {
+			t.Errorf("Get(%q) = %q, %v", key, v.String(), v.Err)
+		}
+	}
+	checkErr(t, db.Close())
+}
+
+func TestStream(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	defer func(size int) { streamChunkSize = size }(streamChunkSize)
+	streamChunkSize = 1024
+
+	opt := Option{Directory: "./testdata", MergeInterval: -1, ValueLogFileMaxSize: 8 << 10}
+
+	value := []byte(strings.Repeat("streaming value;", 2000))
+
+	readAll := func(db *DB, key string) []byte {
+		r, err := db.GetReader([]byte(key))
+		if err != nil {
+			t.Fatalf("GetReader(%q) error = %v", key, err)
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("GetReader(%q) read error = %v", key, err)
+		}
+		return data
+	}
+
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkErr(t, db.PutReader([]byte("stream"), bytes.NewReader(value), int64(len(value))))
+	checkErr(t, db.PutReader([]byte("small"), strings.NewReader("small value"), 11))
+
+	if data := readAll(db, "stream"); !bytes.Equal(data, value) {
+		t.Errorf("GetReader() = %d bytes, want %d", len(data), len(value))
+	}
+	if data := readAll(db, "small"); string(data) != "small value" {
+		t.Errorf("GetReader() = %q, want %q", data, "small value")
+	}
+	if v := db.Get([]byte("stream")); !bytes.Equal(v.Value, value) {
+		t.Errorf("Get() = %d bytes, %v", len(v.Value), v.Err)
+	}
+
+	// 数据不足时写入失败，之前的值不受影响
+	if err := db.PutReader([]byte("stream"), bytes.NewReader(value[:4096]), int64(len(value))); err != io.ErrUnexpectedEOF {
+		t.Errorf("PutReader() with a short reader error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// 读取期间的合并和垃圾回收不影响已经打开的读取
+	r, err := db.GetReader([]byte("stream"))
+	checkErr(t, err)
+	checkErr(t, db.Merge())
+	checkErr(t, db.ValueLogGC(0))
+	data, err := ioutil.ReadAll(r)
+	checkErr(t, err)
+	checkErr(t, r.Close())
+	if !bytes.Equal(data, value) {
+		t.Errorf("GetReader() during garbage collection = %d bytes, want %d", len(data), len(value))
+	}
+	checkErr(t, db.Close())
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readAll(db, "stream"); !bytes.Equal(data, value) {
+		t.Errorf("GetReader() after reopen = %d bytes, want %d", len(data), len(value))
+	}
+
+	// 清单和数据块不一致时读取到末尾返回 ErrChecksum
+	db.mutex.Lock()
+	item, err := db.encoder.Read(db.index.get([]byte("stream")), db.fileList)
+	checkErr(t, err)
+	manifest, err := decodeStreamManifest(item.Value)
+	checkErr(t, err)
+	manifest.checksum++
+	item = NewItem([]byte("stream"), manifest.encode(), item.TimeStamp)
+	item.Flag = flagStreamManifest
+	rec, err := db.write(item)
+	checkErr(t, err)
+	db.setIndex(item.Key, rec)
+	db.mutex.Unlock()
+
+	r, err = db.GetReader([]byte("stream"))
+	checkErr(t, err)
+	if _, err := ioutil.ReadAll(r); err != ErrChecksum {
+		t.Errorf("GetReader() with a wrong checksum error = %v, want %v", err, ErrChecksum)
+	}
+	checkErr(t, r.Close())
+	if v := db.Get([]byte("stream")); v.Err != ErrChecksum {
+		t.Errorf("Get() with a wrong checksum error = %v, want %v", v.Err, ErrChecksum)
+	}
+	checkErr(t, db.Close())
+}
+
+func TestStoreCodec(t *testing.T) {
+	os.RemoveAll("./testdata/")
+
+	db, err := Open(Option{Directory: "./testdata", MergeInterval: -1, Codec: JSONCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := userinfo{Name: "Leon Ding", Age: 22}
+
+	// 默认使用 DB 的 Codec
+	data, err := db.Marshal(&user)
+	checkErr(t, err)
+	if string(data) != `{"Name":"Leon Ding","Age":22}` {
+		t.Errorf("Marshal() = %s, want JSON", data)
+	}
+	checkErr(t, db.Put([]byte("json"), data))
+
+	var u userinfo
+	if err := db.Get([]byte("json")).Unwrap(&u); err != nil || u != user {
+		t.Errorf("Unwrap() = %v, %v", u, err)
+	}
+
+	// 调用时指定其他的 Codec
+	data, err = db.Marshal(&user, GobCodec{})
+	checkErr(t, err)
+	checkErr(t, db.Put([]byte("gob"), data))
+
+	u = userinfo{}
+	if err := db.Get([]byte("gob")).Unwrap(&u, GobCodec{}); err != nil || u != user {
+		t.Errorf("Unwrap(GobCodec) = %v, %v", u, err)
+	}
+	if err := db.Get([]byte("gob")).Unwrap(&u); err == nil {
+		t.Error("Unwrap() of gob data with JSONCodec returned no error")
+	}
+
+	// 读取失败的错误原样返回
+	if err := db.Get([]byte("missing")).Unwrap(&u); err == nil {
+		t.Error("Unwrap() of a missing key returned no error")
+	}
+
+	checkErr(t, db.Update(func(tx *Tx) error {
+		return tx.Get([]byte("json")).Unwrap(&u)
+	}))
+	checkErr(t, db.Close())
 }
@@ -0,0 +1,391 @@
+package step
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// streamChunkSize 流式写入时每个数据块的大小，不超过该大小的值直接写入
+var streamChunkSize = 1 << 20
+
+// flagStreamManifest 数据文件中流式写入的清单
+const flagStreamManifest = flagValuePointer | flagStream
+
+// ErrChecksum 流式读取的数据和写入时的长度或者校验和不一致
+var ErrChecksum = errors.New("stream checksum mismatch")
+
+// errReaderClosed 流式读取已经关闭
+var errReaderClosed = errors.New("the stream reader has been closed")
+
+// streamManifest 流式写入的值的清单，保存在数据文件中，数据块按顺序保存在值日志中
+// | SIZE 8 | CRC 4 | (FID 8 | OFFSET 8 | SIZE 4) ... |
+type streamManifest struct {
+	size     uint64
+	checksum uint32
+	chunks   []valuePointer
+}
+
+// encode 编码清单
+func (m *streamManifest) encode() []byte {
+	buf := make([]byte, 12, 12+len(m.chunks)*valuePointerSize)
+	binary.LittleEndian.PutUint64(buf[0:8], m.size)
+	binary.LittleEndian.PutUint32(buf[8:12], m.checksum)
+	for _, ptr := range m.chunks {
+		buf = append(buf, ptr.encode()...)
+	}
+	return buf
+}
+
+// decodeStreamManifest 解析清单
+func decodeStreamManifest(data []byte) (*streamManifest, error) {
+	if len(data) < 12 || (len(data)-12)%valuePointerSize != 0 {
+		return nil, errors.New("invalid stream manifest")
+	}
+
+	m := &streamManifest{
+		size:     binary.LittleEndian.Uint64(data[0:8]),
+		checksum: binary.LittleEndian.Uint32(data[8:12]),
+	}
+
+	for data = data[12:]; len(data) > 0; data = data[valuePointerSize:] {
+		ptr, err := decodeValuePointer(data[:valuePointerSize])
+		if err != nil {
+			return nil, err
+		}
+		m.chunks = append(m.chunks, ptr)
+	}
+
+	return m, nil
+}
+
+// find 返回值日志中指定位置的数据块在清单中的序号，不存在时返回 -1
+func (m *streamManifest) find(fid, offset int64) int {
+	for i, ptr := range m.chunks {
+		if ptr.FID == fid && ptr.Offset == offset {
+			return i
+		}
+	}
+	return -1
+}
+
+// PutReader 从 r 中读取 size 字节作为键的值，较大的值分块写入值日志，不需要一次性读取到内存中
+// 所有的数据块写入之后才写入数据文件中的清单，写入失败时之前的值不受影响
+func (db *DB) PutReader(key []byte, r io.Reader, size int64, actionFunc ...func(action *Action)) error {
+	if size < 0 {
+		return errors.New("the value size cannot be negative")
+	}
+
+	if size <= int64(streamChunkSize) {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		return db.Put(key, value, actionFunc...)
+	}
+
+	var action Action
+
+	for _, fn := range actionFunc {
+		fn(&action)
+	}
+
+	item := NewItem(key, nil, uint64(time.Now().UnixNano()))
+	item.ExpireTime = action.expireTime()
+
+	// 清单写入之前数据块没有被引用，期间不能被值日志的垃圾回收删除
+	db.mutex.Lock()
+	start := db.vlog.fid
+	db.vlog.streams[start]++
+	db.mutex.Unlock()
+
+	defer func() {
+		db.mutex.Lock()
+		if db.vlog.streams[start]--; db.vlog.streams[start] <= 0 {
+			delete(db.vlog.streams, start)
+		}
+		db.mutex.Unlock()
+	}()
+
+	manifest, err := db.writeChunks(item, r, size)
+	if err != nil {
+		return err
+	}
+
+	item.Value = manifest.encode()
+	item.Flag = flagStreamManifest
+
+	ticket, err := db.put(item)
+	if err != nil {
+		return err
+	}
+
+	return db.sync(ticket)
+}
+
+// writeChunks 将 r 中的数据分块写入值日志，每个数据块只在写入时持有写锁
+func (db *DB) writeChunks(item *Item, r io.Reader, size int64) (*streamManifest, error) {
+	var (
+		manifest = &streamManifest{size: uint64(size)}
+		buf      = make([]byte, streamChunkSize)
+	)
+
+	for written := int64(0); written < size; {
+		n := int64(len(buf))
+		if size-written < n {
+			n = size - written
+		}
+
+		// 数据少于 size 时不能写入清单
+		if _, err := io.ReadFull(r, buf[:n]); err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		manifest.checksum = crc32.Update(manifest.checksum, crc32.IEEETable, buf[:n])
+
+		chunk := NewItem(item.Key, buf[:n], item.TimeStamp)
+		chunk.ExpireTime = item.ExpireTime
+		chunk.Flag = flagStream
+
+		db.mutex.Lock()
+		ptr, err := db.appendValueLog(chunk)
+		db.mutex.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.chunks = append(manifest.chunks, ptr)
+		written += n
+	}
+
+	return manifest, nil
+}
+
+// streamingSince 判断是否有流式写入可能在该值日志文件中写入了还没有被引用的数据块，调用者需要持有锁
+func (db *DB) streamingSince(fid int64) bool {
+	for start := range db.vlog.streams {
+		if fid >= start {
+			return true
+		}
+	}
+	return false
+}
+
+// GetReader 返回读取键对应的值的 io.ReadCloser，流式写入的值按数据块依次读取
+// 读取到末尾时校验长度和校验和，不一致时返回 ErrChecksum
+// 读取期间持有快照，使用完毕后需要调用 Close 释放
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	rec := db.index.get(key)
+
+	if rec == nil {
+		return nil, errors.New("the current key does not exist")
+	}
+
+	if rec.expired(uint64(time.Now().UnixNano())) {
+		return nil, errors.New("the current key has expired")
+	}
+
+	item, err := db.encoder.Read(rec, db.fileList)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(item.Key, key) {
+		return nil, errors.New("the data record does not match the current key")
+	}
+
+	// 其他的值已经在内存中
+	if item.Flag&flagStream == 0 {
+		if item, err = db.resolve(item); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(item.Value)), nil
+	}
+
+	manifest, err := decodeStreamManifest(item.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// 快照保证读取期间被垃圾回收的值日志文件不会被删除
+	db.snapshots[db.seq]++
+
+	return &streamReader{
+		db:       db,
+		key:      item.Key,
+		manifest: manifest,
+		snapshot: db.seq,
+	}, nil
+}
+
+// readStream 读取清单中的所有数据块并校验，调用者需要持有锁
+func (db *DB) readStream(item *Item) (*Item, error) {
+	manifest, err := decodeStreamManifest(item.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, 0, manifest.size)
+
+	for _, ptr := range manifest.chunks {
+		chunk, err := db.readChunk(item.Key, ptr)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, chunk...)
+	}
+
+	if uint64(len(value)) != manifest.size || crc32.ChecksumIEEE(value) != manifest.checksum {
+		return nil, ErrChecksum
+	}
+
+	item.Value = value
+	item.Flag &^= flagStreamManifest
+
+	return item, nil
+}
+
+// readChunk 读取值日志中的一个数据块，调用者需要持有锁
+func (db *DB) readChunk(key []byte, ptr valuePointer) ([]byte, error) {
+	chunk, err := db.readValueLog(key, ptr)
+	if err != nil {
+		return nil, err
+	}
+	if chunk.Flag&flagStream == 0 {
+		return nil, errors.New("the value log entry is not a stream chunk")
+	}
+	return chunk.Value, nil
+}
+
+// relocateChunk 将仍然被清单引用的数据块重新写入值日志，并写入新的清单
+func (db *DB) relocateChunk(v liveValue, entry *Item) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// 同一个清单中的其他数据块可能已经被重新写入，需要读取最新的清单
+	rec := db.index.get(v.rec.Key)
+	if rec == nil {
+		return nil
+	}
+
+	item, err := db.encoder.Read(rec, db.fileList)
+	if err != nil {
+		return err
+	}
+	if item.Flag&flagStreamManifest != flagStreamManifest {
+		return nil
+	}
+
+	manifest, err := decodeStreamManifest(item.Value)
+	if err != nil {
+		return err
+	}
+
+	i := manifest.find(v.entry.FID, v.entry.Offset)
+	if i < 0 {
+		return nil
+	}
+
+	chunk := NewItem(rec.Key, entry.Value, rec.Timestamp)
+	chunk.ExpireTime = rec.ExpireTime
+	chunk.Flag = flagStream
+
+	if manifest.chunks[i], err = db.appendValueLog(chunk); err != nil {
+		return err
+	}
+
+	item = NewItem(rec.Key, manifest.encode(), rec.Timestamp)
+	item.ExpireTime = rec.ExpireTime
+	item.Flag = flagStreamManifest
+
+	updated, err := db.write(item)
+	if err != nil {
+		return err
+	}
+
+	db.seq++
+	db.setIndex(item.Key, updated)
+
+	return nil
+}
+
+// streamReader 按数据块依次读取流式写入的值
+type streamReader struct {
+	db       *DB
+	key      []byte
+	manifest *streamManifest
+	snapshot uint64
+
+	// 下一个读取的数据块
+	next int
+	// 当前数据块中还没有读取的数据
+	buf []byte
+	// 已经读取的长度和校验和
+	size     uint64
+	checksum uint32
+
+	err    error
+	closed bool
+}
+
+// Read 读取数据，当前数据块读取完毕时读取下一个数据块
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errReaderClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	for len(r.buf) == 0 {
+		if r.next >= len(r.manifest.chunks) {
+			r.err = io.EOF
+			if r.size != r.manifest.size || r.checksum != r.manifest.checksum {
+				r.err = ErrChecksum
+			}
+			return 0, r.err
+		}
+
+		r.db.mutex.RLock()
+		chunk, err := r.db.readChunk(r.key, r.manifest.chunks[r.next])
+		r.db.mutex.RUnlock()
+
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+
+		r.next++
+		r.buf = chunk
+		r.size += uint64(len(chunk))
+		r.checksum = crc32.Update(r.checksum, crc32.IEEETable, chunk)
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// Close 释放读取期间持有的快照
+func (r *streamReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	r.db.mutex.Lock()
+	r.db.releaseSnapshot(r.snapshot)
+	r.db.mutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package step
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncMode 数据文件的刷盘策略
+type SyncMode uint8
+
+const (
+	// SyncNever 由操作系统决定刷盘的时机，只在关闭数据文件时刷盘
+	SyncNever SyncMode = iota
+	// SyncAlways 每次写入都等待刷盘完成，并发的写入共享同一次刷盘
+	SyncAlways
+	// SyncInterval 后台协程按照固定的时间间隔刷盘
+	SyncInterval
+)
+
+// defaultSyncInterval 默认的后台刷盘间隔
+var defaultSyncInterval = time.Second
+
+// groupCommit 合并并发写入的刷盘操作
+// 正在刷盘时到达的写入会等待下一次刷盘，一次刷盘可以覆盖多个写入
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  uint64 // 已经落盘的写入序号
+	syncing bool   // 是否有协程正在刷盘
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// sync 按照刷盘策略等待序号为 ticket 的写入落盘
+func (db *DB) sync(ticket uint64) error {
+	if db.syncMode != SyncAlways {
+		return nil
+	}
+
+	g := db.group
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.synced < ticket {
+		// 已经有协程在刷盘，等待它完成后再检查是否覆盖了当前的写入
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		g.mu.Unlock()
+
+		target, err := db.syncActiveFile()
+
+		g.mu.Lock()
+		g.syncing = false
+		if err == nil && target > g.synced {
+			g.synced = target
+		}
+		g.cond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncActiveFile 对当前的可写文件刷盘，返回刷盘覆盖到的写入序号
+func (db *DB) syncActiveFile() (uint64, error) {
+	db.mutex.RLock()
+	active, vlog, target := db.active, db.vlog.active, db.writes
+	db.mutex.RUnlock()
+
+	// 值日志先于指向它的指针落盘
+	if vlog != nil {
+		if err := vlog.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return 0, err
+		}
+	}
+
+	// 刷盘期间可写文件被切换或者关闭时，关闭前已经完成了刷盘
+	if err := active.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return 0, err
+	}
+
+	return target, nil
+}
+
+// startSync 按照刷盘策略启动后台刷盘的协程
+func (db *DB) startSync(opt Option) {
+	if db.syncMode != SyncInterval {
+		return
+	}
+
+	interval := defaultSyncInterval
+	if opt.SyncInterval > 0 {
+		interval = time.Duration(opt.SyncInterval) * time.Millisecond
+	}
+
+	db.wg.Add(1)
+
+	go func() {
+		defer db.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = db.syncActiveFile()
+			case <-db.closing:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,265 @@
+package step
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrTxConflict 事务读取或者写入的键在事务开始之后被其他写操作修改
+	ErrTxConflict = errors.New("transaction conflict, the keys were modified by another writer")
+
+	// errTxReadOnly 只读事务中不能进行写操作
+	errTxReadOnly = errors.New("cannot write in a read-only transaction")
+
+	// errTxClosed 事务已经提交或者回滚
+	errTxClosed = errors.New("the transaction has been closed")
+)
+
+// version 事务快照存在期间被覆盖或者删除的旧版本
+// 版本号小于 until 的快照读取到的是 rec，rec 为 nil 表示当时该键不存在
+type version struct {
+	rec   *record
+	until uint64
+}
+
+// Tx 读写事务
+// 事务中读取到的是事务开始时的快照，写操作在提交时原子地写入数据文件
+type Tx struct {
+	db       *DB
+	snapshot uint64           // 事务开始时的版本号
+	writable bool             // 是否是读写事务
+	closed   bool             // 是否已经提交或者回滚
+	reads    map[string]bool  // 事务中读取过的键
+	writes   map[string]*Item // 事务中还没有提交的写操作
+	order    []string         // 写操作的顺序
+}
+
+// View 在只读事务中执行 fn，fn 中读取到的是一致的快照
+func (db *DB) View(fn func(tx *Tx) error) error {
+	tx := db.begin(false)
+	defer tx.rollback()
+
+	return fn(tx)
+}
+
+// Update 在读写事务中执行 fn，fn 返回 nil 时提交事务
+// 事务中读取或者写入的键在事务开始之后被修改时返回 ErrTxConflict，事务中的写操作不会生效
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	tx := db.begin(true)
+	defer tx.rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.commit()
+}
+
+// begin 以当前的版本号开始一个事务
+func (db *DB) begin(writable bool) *Tx {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.snapshots[db.seq]++
+
+	return &Tx{
+		db:       db,
+		snapshot: db.seq,
+		writable: writable,
+		reads:    make(map[string]bool),
+		writes:   make(map[string]*Item),
+	}
+}
+
+// Get 读取事务快照中指定键的数据对象，读写事务中可以读取到自己还没有提交的写操作
+func (tx *Tx) Get(key []byte) (data *Data) {
+	data = &Data{codec: tx.db.codec}
+
+	if tx.closed {
+		data.Err = errTxClosed
+		return
+	}
+
+	if item, ok := tx.writes[string(key)]; ok {
+		if item.Flag&flagTombstone != 0 || expiredAt(item.ExpireTime, uint64(time.Now().UnixNano())) {
+			data.Err = errors.New("the current key does not exist")
+			return
+		}
+		data.Item = NewItem(item.Key, item.Value, item.TimeStamp)
+		return
+	}
+
+	tx.reads[string(key)] = true
+
+	tx.db.mutex.RLock()
+	defer tx.db.mutex.RUnlock()
+
+	rec := tx.db.snapshotGet(key, tx.snapshot)
+
+	if rec == nil {
+		data.Err = errors.New("the current key does not exist")
+		return
+	}
+
+	if rec.expired(uint64(time.Now().UnixNano())) {
+		data.Err = errors.New("the current key has expired")
+		return
+	}
+
+	item, err := tx.db.read(rec)
+	if err != nil {
+		data.Err = err
+		return
+	}
+
+	if !bytes.Equal(item.Key, key) {
+		data.Err = errors.New("the data record does not match the current key")
+		return
+	}
+	data.Item = item
+	return
+}
+
+// Put 在事务中写入 KV，提交事务时生效
+func (tx *Tx) Put(key, value []byte, actionFunc ...func(action *Action)) error {
+	var action Action
+
+	for _, fn := range actionFunc {
+		fn(&action)
+	}
+
+	item := NewItem(append([]byte(nil), key...), append([]byte(nil), value...), 0)
+	item.ExpireTime = action.expireTime()
+
+	return tx.write(item)
+}
+
+// Delete 在事务中删除指定的键，提交事务时生效
+func (tx *Tx) Delete(key []byte) error {
+	item := NewItem(append([]byte(nil), key...), nil, 0)
+	item.Flag = flagTombstone
+
+	return tx.write(item)
+}
+
+func (tx *Tx) write(item *Item) error {
+	if tx.closed {
+		return errTxClosed
+	}
+
+	if !tx.writable {
+		return errTxReadOnly
+	}
+
+	if _, ok := tx.writes[string(item.Key)]; !ok {
+		tx.order = append(tx.order, string(item.Key))
+	}
+	tx.writes[string(item.Key)] = item
+
+	return nil
+}
+
+// commit 检查冲突并提交事务中的写操作
+func (tx *Tx) commit() error {
+	if tx.closed {
+		return errTxClosed
+	}
+
+	ticket, err := tx.apply()
+	if err != nil {
+		return err
+	}
+
+	return tx.db.sync(ticket)
+}
+
+// apply 检查冲突后写入事务中的写操作，返回本次写入的序号
+func (tx *Tx) apply() (uint64, error) {
+	db := tx.db
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	defer tx.release()
+
+	if len(tx.writes) == 0 {
+		return 0, nil
+	}
+
+	// 事务开始之后被修改过的键都会留下旧版本
+	for key := range tx.reads {
+		if db.modifiedSince(key, tx.snapshot) {
+			return 0, ErrTxConflict
+		}
+	}
+	for key := range tx.writes {
+		if db.modifiedSince(key, tx.snapshot) {
+			return 0, ErrTxConflict
+		}
+	}
+
+	items := make([]*Item, 0, len(tx.order))
+	for _, key := range tx.order {
+		items = append(items, tx.writes[key])
+	}
+
+	if err := db.writeBatch(items); err != nil {
+		return 0, err
+	}
+
+	return db.writes, nil
+}
+
+// rollback 放弃事务中的写操作并释放快照
+func (tx *Tx) rollback() {
+	if tx.closed {
+		return
+	}
+
+	tx.db.mutex.Lock()
+	defer tx.db.mutex.Unlock()
+
+	tx.release()
+}
+
+// release 释放事务的快照，调用者需要持有写锁
+func (tx *Tx) release() {
+	tx.closed = true
+	tx.db.releaseSnapshot(tx.snapshot)
+}
+
+// releaseSnapshot 释放指定版本号的快照，调用者需要持有写锁
+func (db *DB) releaseSnapshot(snapshot uint64) {
+	if db.snapshots[snapshot]--; db.snapshots[snapshot] <= 0 {
+		delete(db.snapshots, snapshot)
+	}
+
+	// 没有事务快照时不再需要保留旧版本，合并后的旧数据文件也可以删除了
+	if len(db.snapshots) == 0 {
+		db.history = make(map[string][]version)
+		if len(db.obsolete) > 0 && db.removeDataFiles(db.obsolete) == nil {
+			db.obsolete = nil
+		}
+		if len(db.vlog.obsolete) > 0 && db.removeValueLogFiles(db.vlog.obsolete) == nil {
+			db.vlog.obsolete = nil
+		}
+	}
+}
+
+// snapshotGet 读取指定版本号的快照中键对应的 record，调用者需要持有锁
+func (db *DB) snapshotGet(key []byte, snapshot uint64) *record {
+	for _, v := range db.history[string(key)] {
+		if snapshot < v.until {
+			return v.rec
+		}
+	}
+	return db.index.get(key)
+}
+
+// modifiedSince 判断键在指定版本号之后是否被修改过，调用者需要持有锁
+func (db *DB) modifiedSince(key string, snapshot uint64) bool {
+	versions := db.history[key]
+	return len(versions) > 0 && versions[len(versions)-1].until > snapshot
+}
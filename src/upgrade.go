@@ -0,0 +1,361 @@
+package step
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// UpgradeOption 升级数据目录时的附加选项
+type UpgradeOption struct {
+	// 旧格式的文件没有记录是否加密，需要由调用者指定
+	Encrypted bool
+}
+
+// Upgrade 将数据目录中旧格式的数据文件改写为当前格式，已经是当前格式的文件原样复制
+// 新的文件先写入 dir.upgrade，校验记录数量和校验和之后替换原来的目录，原来的目录保留为 dir.backup
+// 升级期间不能有 DB 打开这个目录
+func Upgrade(dir string, optionFunc ...func(opt *UpgradeOption)) error {
+	var opt UpgradeOption
+
+	for _, fn := range optionFunc {
+		fn(&opt)
+	}
+
+	dir = strings.TrimSuffix(strings.TrimSpace(dir), "/")
+	if dir == "" {
+		return errors.New("the data file directory cannot be empty")
+	}
+
+	var (
+		src    = newDB(Option{Directory: dir + "/", Enable: opt.Encrypted})
+		dst    = newDB(Option{Directory: dir + ".upgrade/"})
+		backup = dir + ".backup"
+	)
+
+	ids, err := src.dataFileIDs()
+	if err != nil {
+		return err
+	}
+
+	if ok, err := src.needUpgrade(ids); err != nil || !ok {
+		return err
+	}
+
+	// 旧格式的记录是否有效由索引快照决定
+	if src.legacy, err = src.loadLegacySnapshot(); err != nil {
+		return err
+	}
+
+	if ok, err := pathExists(backup); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("backup directory %s already exists", backup)
+	}
+
+	if err := os.RemoveAll(dst.root); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst.dataDirectory, Perm); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst.indexDirectory, Perm); err != nil {
+		return err
+	}
+
+	// 旧格式的文件只可能使用 AES-CBC 和标识符为 0 的密钥加密
+	var flags uint16
+	if opt.Encrypted {
+		flags |= fileEncrypted
+	}
+
+	for i, fid := range ids {
+		if err := upgradeDataFile(src, dst, fid, flags, i == len(ids)-1); err != nil {
+			_ = os.RemoveAll(dst.root)
+			return fmt.Errorf("upgrade data file %d: %w", fid, err)
+		}
+	}
+
+	// 值日志只被数据文件中的指针引用，格式和旧版本无关，原样复制
+	if err := copyValueLog(src, dst); err != nil {
+		_ = os.RemoveAll(dst.root)
+		return fmt.Errorf("copy value log: %w", err)
+	}
+
+	// 被主密钥加密的数据密钥也需要保留
+	if keys, err := src.readKeysFile(); err != nil {
+		_ = os.RemoveAll(dst.root)
+		return err
+	} else if len(keys.keys) > 0 {
+		if err := dst.writeKeysFile(keys); err != nil {
+			_ = os.RemoveAll(dst.root)
+			return err
+		}
+	}
+
+	// 压缩字典原样保留
+	if data, err := ioutil.ReadFile(src.root + dictsFileName); err == nil {
+		if err := writeFileAtomic(dst.root+dictsFileName, data); err != nil {
+			_ = os.RemoveAll(dst.root)
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		_ = os.RemoveAll(dst.root)
+		return err
+	}
+
+	if err := syncDirectory(dst.dataDirectory); err != nil {
+		return err
+	}
+	if err := syncDirectory(dst.indexDirectory); err != nil {
+		return err
+	}
+
+	// 校验通过之后再替换目录
+	if err := os.Rename(dir, backup); err != nil {
+		return err
+	}
+
+	return os.Rename(strings.TrimSuffix(dst.root, "/"), dir)
+}
+
+// needUpgrade 判断目录中是否还有旧格式的数据文件或者提示文件
+func (db *DB) needUpgrade(ids []int64) (bool, error) {
+	for _, fid := range ids {
+		if err := db.checkFile(db.dataSuffixFunc(fid), dataMagic); err != nil {
+			return false, err
+		}
+
+		file, err := db.openReadOnly(fid)
+		if err != nil {
+			return false, err
+		}
+		_ = file.Close()
+
+		if file.version != currentFormat {
+			return true, nil
+		}
+
+		hint, err := os.Open(db.indexSuffixFunc(fid))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		version, _, err := readFileHeader(hint, indexMagic)
+		_ = hint.Close()
+		if err != nil {
+			return false, err
+		}
+
+		if version != currentFormat {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// upgradeDataFile 将一个旧格式的数据文件改写为当前格式，并为写满的数据文件生成提示文件
+// 当前格式的数据文件和提示文件原样复制，保留文件头中的功能标志
+func upgradeDataFile(src, dst *DB, fid int64, flags uint16, last bool) error {
+	file, err := src.openReadOnly(fid)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if file.version == currentFormat {
+		return copyDataFile(src, dst, fid)
+	}
+
+	out, err := dst.openDataFile(os.O_RDWR|os.O_CREATE|os.O_TRUNC, fid)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	writer := &dataFile{File: out, version: currentFormat, flags: flags}
+
+	if _, err := bufToFile(fileHeader(dataMagic, flags), out); err != nil {
+		return err
+	}
+
+	// 只有最后一个数据文件可能因为异常退出而写入不完整的记录
+	count, checksum, err := src.copyRecords(fid, file, writer)
+	if err == errTornRecord && last {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	// 按照当前格式重新读取，记录数量和内容的校验和都需要一致
+	written, verified, err := dst.copyRecords(fid, writer, nil)
+	if err != nil {
+		return err
+	}
+	if written != count || verified != checksum {
+		return fmt.Errorf("verification failed: %d records with checksum %#x, want %d with %#x", written, verified, count, checksum)
+	}
+
+	// 最后一个数据文件在打开时总是会被扫描，不需要提示文件
+	if last {
+		return nil
+	}
+
+	items, _, err := dst.scanDataFile(fid)
+	if err != nil {
+		return err
+	}
+
+	if err := dst.writeHintFile(fid, items); err != nil {
+		return err
+	}
+
+	hints, err := dst.readHintFile(fid)
+	if err != nil {
+		return err
+	}
+	if len(hints) != len(items) {
+		return fmt.Errorf("verification failed: %d hint entries, want %d", len(hints), len(items))
+	}
+
+	return nil
+}
+
+// copyDataFile 原样复制当前格式的数据文件和它的提示文件
+func copyDataFile(src, dst *DB, fid int64) error {
+	if err := copyFile(src.dataSuffixFunc(fid), dst.dataSuffixFunc(fid)); err != nil {
+		return err
+	}
+
+	err := copyFile(src.indexSuffixFunc(fid), dst.indexSuffixFunc(fid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// copyValueLog 原样复制值日志文件夹中的所有文件
+func copyValueLog(src, dst *DB) error {
+	files, err := ioutil.ReadDir(src.vlog.directory)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dst.vlog.directory, Perm); err != nil {
+		return err
+	}
+
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+		if err := copyFile(src.vlog.directory+info.Name(), dst.vlog.directory+info.Name()); err != nil {
+			return err
+		}
+	}
+
+	return syncDirectory(dst.vlog.directory)
+}
+
+// copyFile 原样复制文件并落盘，复制之后重新读取并比较校验和
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_RDWR|os.O_CREATE|os.O_TRUNC, Perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	want := crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(out, want), in); err != nil {
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	got := crc32.NewIEEE()
+	if _, err := io.Copy(got, io.NewSectionReader(out, 0, math.MaxInt64)); err != nil {
+		return err
+	}
+
+	if got.Sum32() != want.Sum32() {
+		return fmt.Errorf("verification failed: %s has checksum %#x, want %#x", to, got.Sum32(), want.Sum32())
+	}
+
+	return nil
+}
+
+// copyRecords 按顺序读取数据文件中的所有记录并以当前格式写入 out，out 为 nil 时只读取
+// 旧格式的记录按照索引快照过滤，并补齐过期时间
+// 返回写入的记录的数量和记录内容的校验和，校验和与记录的编码格式无关
+// 遇到不完整的记录时停止并返回 errTornRecord
+func (db *DB) copyRecords(fid int64, file, out *dataFile) (int, uint32, error) {
+	var (
+		count    int
+		checksum uint32
+		offset   = dataOffset(file.version)
+		buf      = make([]byte, 17)
+	)
+
+	for {
+		item, size, err := db.encoder.readItemAt(file, offset)
+		if err == io.EOF {
+			return count, checksum, nil
+		}
+		if err != nil {
+			return count, checksum, err
+		}
+
+		rec := &record{FID: fid, Offset: offset, Timestamp: item.TimeStamp}
+		offset += int64(size)
+
+		// 已经删除的旧记录不再写入
+		if file.version == formatV1 {
+			if !db.legacy.keep(db.hashed.Sum64(item.Key), rec) {
+				continue
+			}
+			item.ExpireTime = rec.ExpireTime
+		}
+
+		// | TS 8 | ET 8 | FG 1 | KEY ? | VALUE ? |
+		binary.LittleEndian.PutUint64(buf[0:8], item.TimeStamp)
+		binary.LittleEndian.PutUint64(buf[8:16], item.ExpireTime)
+		buf[16] = item.Flag
+		checksum = crc32.Update(checksum, crc32.IEEETable, buf)
+		checksum = crc32.Update(checksum, crc32.IEEETable, item.Key)
+		checksum = crc32.Update(checksum, crc32.IEEETable, item.Value)
+
+		// 值保持原样写入，加密的数据不需要解密
+		if out != nil {
+			if _, err := bufToFile(binaryEncode(item), out.File); err != nil {
+				return count, checksum, err
+			}
+		}
+
+		count++
+	}
+}
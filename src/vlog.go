@@ -0,0 +1,495 @@
+package step
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vlogMagic 值日志文件的魔数
+var vlogMagic = []byte("STPV")
+
+// vlogFileSuffix 值日志文件的扩展名
+const vlogFileSuffix = ".vlog"
+
+// defaultValueLogFileSize 值日志文件的默认最大尺寸
+var defaultValueLogFileSize int64 = 2 << 8 << 20
+
+// errCollecting 已经有值日志的垃圾回收正在进行
+var errCollecting = errors.New("a value log garbage collection is already in progress")
+
+// errStreaming 有流式写入正在进行，值日志不能全部重新写入
+var errStreaming = errors.New("a stream is being written to the value log")
+
+// valuePointerSize 数据文件中指向值日志的指针长度
+// | FID 8 | OFFSET 8 | SIZE 4 |
+const valuePointerSize = 20
+
+// valueLog WiscKey 风格的值日志，较大的值单独写入值日志，数据文件中只保存指向它的指针
+// 合并数据文件时只需要复制指针，值日志中的无效数据由垃圾回收单独清理
+// 值日志中的每一项和数据文件中的记录使用相同的编码，同样会被压缩和加密
+type valueLog struct {
+	// 值日志所在的文件夹
+	directory string
+
+	// 不小于该长度的值写入值日志，0 表示不使用值日志
+	threshold int
+
+	// 值日志文件的最大尺寸
+	maxFileSize int64
+
+	// 后台垃圾回收的无效数据比例，0 表示不在后台回收
+	gcRatio float64
+
+	// 所有值日志文件的文件描述符，包括当前可写的文件
+	files map[int64]*dataFile
+
+	// 当前可写的值日志文件，第一次写入时创建
+	active *os.File
+
+	// 当前可写文件的标识符
+	fid int64
+
+	// 写入当前可写文件的偏移值
+	offset int64
+
+	// 是否正在进行垃圾回收
+	collecting bool
+
+	// 垃圾回收之后仍然被事务快照引用的值日志文件，快照释放后删除
+	obsolete []int64
+
+	// 正在写入的流式数据开始时的值日志文件 [fid -> 数量]，这些文件之后的文件不参与垃圾回收
+	streams map[int64]int
+}
+
+// valuePointer 数据文件中指向值日志的指针
+type valuePointer struct {
+	FID    int64
+	Offset int64
+	Size   uint32
+}
+
+// encode 编码指针
+func (p valuePointer) encode() []byte {
+	buf := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(p.FID))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(p.Offset))
+	binary.LittleEndian.PutUint32(buf[16:20], p.Size)
+	return buf
+}
+
+// decodeValuePointer 解析指针
+func decodeValuePointer(data []byte) (valuePointer, error) {
+	if len(data) != valuePointerSize {
+		return valuePointer{}, errors.New("invalid value log pointer")
+	}
+	return valuePointer{
+		FID:    int64(binary.LittleEndian.Uint64(data[0:8])),
+		Offset: int64(binary.LittleEndian.Uint64(data[8:16])),
+		Size:   binary.LittleEndian.Uint32(data[16:20]),
+	}, nil
+}
+
+// vlogSuffixFunc 构建值日志文件名 [文件夹 + 版本.vlog]
+func (db *DB) vlogSuffixFunc(fid int64) string {
+	return fmt.Sprintf("%s%d%s", db.vlog.directory, fid, vlogFileSuffix)
+}
+
+// openValueLog 打开已有的值日志文件，新的值日志文件在第一次写入时创建
+func (db *DB) openValueLog() error {
+	files, err := ioutil.ReadDir(db.vlog.directory)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range files {
+		if path.Ext(info.Name()) != vlogFileSuffix {
+			continue
+		}
+		fid, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), vlogFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		file, err := os.Open(db.vlogSuffixFunc(fid))
+		if err != nil {
+			return err
+		}
+
+		version, flags, err := readFileHeader(file, vlogMagic)
+		if err == nil && (version != currentFormat || flags&^knownFileFlags != 0) {
+			err = fmt.Errorf("%s is not a valid value log file", file.Name())
+		}
+		if err == nil && (flags&fileEncrypted != 0) != db.encoder.enable {
+			err = fmt.Errorf("%s does not match the encryption option", file.Name())
+		}
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+
+		db.vlog.files[fid] = &dataFile{File: file, version: version, flags: flags}
+		if fid > db.vlog.fid {
+			db.vlog.fid = fid
+		}
+	}
+
+	return nil
+}
+
+// createValueLogFile 创建新的可写值日志文件，调用者需要持有写锁
+func (db *DB) createValueLogFile() error {
+	if db.vlog.active != nil {
+		if err := db.vlog.active.Sync(); err != nil {
+			return err
+		}
+		if err := db.vlog.active.Close(); err != nil {
+			return err
+		}
+		file, err := os.Open(db.vlogSuffixFunc(db.vlog.fid))
+		if err != nil {
+			return err
+		}
+		db.vlog.files[db.vlog.fid].File = file
+	}
+
+	if err := os.MkdirAll(db.vlog.directory, Perm); err != nil {
+		return err
+	}
+
+	// 已有的值日志文件只读，总是写入新的文件
+	db.vlog.fid++
+
+	file, err := os.OpenFile(db.vlogSuffixFunc(db.vlog.fid), FRW, Perm)
+	if err != nil {
+		return err
+	}
+
+	flags := db.dataFlags()
+	if _, err := bufToFile(fileHeader(vlogMagic, flags), file); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	db.vlog.active = file
+	db.vlog.offset = fileHeaderSize
+	db.vlog.files[db.vlog.fid] = &dataFile{File: file, version: currentFormat, flags: flags}
+
+	return nil
+}
+
+// separateValue 较大的值写入值日志，item 的值替换为指向它的指针，调用者需要持有写锁
+func (db *DB) separateValue(item *Item) error {
+	if db.vlog.threshold == 0 || len(item.Value) < db.vlog.threshold || item.Flag&(flagTombstone|flagBatchCommit|flagValuePointer) != 0 {
+		return nil
+	}
+
+	// 值日志中的记录不属于批量写入，是否生效由数据文件中的指针决定
+	entry := NewItem(item.Key, item.Value, item.TimeStamp)
+	entry.ExpireTime = item.ExpireTime
+
+	ptr, err := db.appendValueLog(entry)
+	if err != nil {
+		return err
+	}
+
+	item.Value = ptr.encode()
+	item.Flag |= flagValuePointer
+
+	return nil
+}
+
+// appendValueLog 将 entry 追加到值日志中并返回指向它的指针，调用者需要持有写锁
+func (db *DB) appendValueLog(entry *Item) (valuePointer, error) {
+	if db.vlog.active == nil || db.vlog.offset >= db.vlog.maxFileSize {
+		if err := db.createValueLogFile(); err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	data, err := db.encoder.encode(entry)
+	if err != nil {
+		return valuePointer{}, err
+	}
+
+	if _, err := bufToFile(data, db.vlog.active); err != nil {
+		return valuePointer{}, err
+	}
+
+	ptr := valuePointer{FID: db.vlog.fid, Offset: db.vlog.offset, Size: uint32(len(data))}
+	db.vlog.offset += int64(len(data))
+
+	return ptr, nil
+}
+
+// read 读取 record 对应的 item，值保存在值日志中时从值日志中读取，调用者需要持有锁
+func (db *DB) read(rec *record) (*Item, error) {
+	item, err := db.encoder.Read(rec, db.fileList)
+	if err != nil {
+		return nil, err
+	}
+	return db.resolve(item)
+}
+
+// resolve 将数据文件中指向值日志的指针替换为实际的值，调用者需要持有锁
+func (db *DB) resolve(item *Item) (*Item, error) {
+	if item.Flag&flagValuePointer == 0 {
+		return item, nil
+	}
+
+	// 流式写入的值分块保存在值日志中，需要读取所有的数据块
+	if item.Flag&flagStream != 0 {
+		return db.readStream(item)
+	}
+
+	ptr, err := decodeValuePointer(item.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := db.readValueLog(item.Key, ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Value = value.Value
+	item.Flag &^= flagValuePointer
+
+	return item, nil
+}
+
+// readValueLog 读取指针指向的值日志中的一项，调用者需要持有锁
+func (db *DB) readValueLog(key []byte, ptr valuePointer) (*Item, error) {
+	value, err := db.encoder.Read(&record{FID: ptr.FID, Offset: ptr.Offset, Size: ptr.Size}, db.vlog.files)
+	if err != nil {
+		return nil, fmt.Errorf("value log %d: %w", ptr.FID, err)
+	}
+
+	// 值日志中的键必须和数据文件中的键一致
+	if !bytes.Equal(value.Key, key) {
+		return nil, errors.New("the value log entry does not match the current key")
+	}
+
+	return value, nil
+}
+
+// ValueLogGC 清理值日志，无效数据超过 ratio 的值日志文件中仍然有效的值会重新写入，然后删除该文件
+// 垃圾回收和合并数据文件相互独立，期间可以正常读写
+func (db *DB) ValueLogGC(ratio float64) error {
+	if ratio < 0 || ratio > 1 {
+		return errors.New("the garbage ratio must be between 0 and 1")
+	}
+	return db.collectValueLogs(ratio, false)
+}
+
+// collectValueLogs 依次检查所有不可写的值日志文件
+// all 为 true 时先切换到新的可写文件，所有已有的值日志文件都使用当前的密钥重新写入
+func (db *DB) collectValueLogs(ratio float64, all bool) error {
+	db.mutex.Lock()
+	if db.vlog.collecting {
+		db.mutex.Unlock()
+		return errCollecting
+	}
+
+	if all {
+		// 正在写入的数据块可能使用旧的密钥，并且不能被重新写入
+		if len(db.vlog.streams) > 0 {
+			db.mutex.Unlock()
+			return errStreaming
+		}
+		if db.vlog.active != nil {
+			if err := db.createValueLogFile(); err != nil {
+				db.mutex.Unlock()
+				return err
+			}
+		}
+	}
+	db.vlog.collecting = true
+
+	// 可写的值日志文件和正在流式写入的数据块所在的文件不参与垃圾回收
+	var ids []int64
+	for fid := range db.vlog.files {
+		if (fid != db.vlog.fid || db.vlog.active == nil) && !db.streamingSince(fid) {
+			ids = append(ids, fid)
+		}
+	}
+	db.mutex.Unlock()
+
+	defer func() {
+		db.mutex.Lock()
+		db.vlog.collecting = false
+		db.mutex.Unlock()
+	}()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, fid := range ids {
+		if err := db.collectValueLog(fid, ratio); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// liveValue 值日志中仍然被索引引用的一项
+type liveValue struct {
+	rec   *record
+	entry *record
+}
+
+// collectValueLog 检查一个值日志文件，无效数据超过 ratio 时重新写入有效的值并删除它
+func (db *DB) collectValueLog(fid int64, ratio float64) error {
+	db.mutex.RLock()
+	file := db.vlog.files[fid]
+	db.mutex.RUnlock()
+
+	var (
+		live      []liveValue
+		liveSize  int64
+		totalSize int64
+		offset    int64 = fileHeaderSize
+		now             = uint64(time.Now().UnixNano())
+	)
+
+	for {
+		item, size, err := db.encoder.readItemAt(file, offset)
+		if err == io.EOF {
+			break
+		}
+		// 异常退出时值日志末尾可能有不完整的记录，它们不会被任何指针引用
+		// 其他校验失败的记录之后可能还有有效的值，没有完整读取的文件不能删除
+		if err == errTornRecord {
+			torn, err := db.encoder.tornTail(file, offset)
+			if err != nil {
+				return err
+			}
+			if !torn {
+				return fmt.Errorf("value log %d is corrupted at offset %d", fid, offset)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		totalSize += int64(size)
+
+		db.mutex.RLock()
+		rec := db.index.get(item.Key)
+		var pointer *Item
+		if rec != nil && !rec.expired(now) {
+			pointer, err = db.encoder.Read(rec, db.fileList)
+		}
+		db.mutex.RUnlock()
+
+		if err != nil {
+			return err
+		}
+
+		if pointer != nil && pointer.Flag&flagValuePointer != 0 && references(pointer, fid, offset) {
+			live = append(live, liveValue{rec: rec, entry: &record{FID: fid, Offset: offset, Size: uint32(size)}})
+			liveSize += int64(size)
+		}
+
+		offset += int64(size)
+	}
+
+	if totalSize > 0 && float64(totalSize-liveSize)/float64(totalSize) < ratio {
+		return nil
+	}
+
+	for _, v := range live {
+		if err := db.relocateValue(v); err != nil {
+			return err
+		}
+	}
+
+	// 新的值和指针落盘之后才能删除旧的值日志文件
+	if _, err := db.syncActiveFile(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if len(db.snapshots) > 0 {
+		db.vlog.obsolete = append(db.vlog.obsolete, fid)
+		return nil
+	}
+
+	return db.removeValueLogFiles([]int64{fid})
+}
+
+// references 判断数据文件中的指针或者流式写入的清单是否引用值日志中指定位置的一项
+func references(pointer *Item, fid, offset int64) bool {
+	if pointer.Flag&flagStream != 0 {
+		manifest, err := decodeStreamManifest(pointer.Value)
+		return err == nil && manifest.find(fid, offset) >= 0
+	}
+	ptr, err := decodeValuePointer(pointer.Value)
+	return err == nil && ptr.FID == fid && ptr.Offset == offset
+}
+
+// relocateValue 将仍然有效的值重新写入，期间键被修改时不再需要
+func (db *DB) relocateValue(v liveValue) error {
+	db.mutex.RLock()
+	entry, err := db.encoder.Read(v.entry, db.vlog.files)
+	db.mutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	// 流式写入的数据块只替换清单中对应的指针
+	if entry.Flag&flagStream != 0 {
+		return db.relocateChunk(v, entry)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.index.get(v.rec.Key) != v.rec {
+		return nil
+	}
+
+	item := NewItem(v.rec.Key, entry.Value, v.rec.Timestamp)
+	item.ExpireTime = v.rec.ExpireTime
+
+	rec, err := db.write(item)
+	if err != nil {
+		return err
+	}
+
+	db.seq++
+	db.setIndex(item.Key, rec)
+
+	return nil
+}
+
+// removeValueLogFiles 关闭并删除值日志文件，调用者需要持有写锁
+func (db *DB) removeValueLogFiles(ids []int64) error {
+	for _, fid := range ids {
+		if file, ok := db.vlog.files[fid]; ok {
+			_ = file.Close()
+			delete(db.vlog.files, fid)
+		}
+		if err := os.Remove(db.vlogSuffixFunc(fid)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}